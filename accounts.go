@@ -0,0 +1,212 @@
+package main
+
+import (
+	jsonStr "encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// account 一个上游 Kiro 账号及其运行状态
+type account struct {
+	Name      string
+	TokenPath string
+
+	disabled         bool
+	lastRefresh      time.Time
+	lastRefreshError string
+	lastSuccess      time.Time
+	lastFailure      time.Time
+	lastError        string
+}
+
+// accountStatus 账号状态快照，用于管理接口
+type accountStatus struct {
+	Name             string     `json:"name"`
+	Health           string     `json:"health"` // healthy、unhealthy、disabled 或 unknown（还没有请求过上游）
+	Disabled         bool       `json:"disabled"`
+	TokenPath        string     `json:"token_path"`
+	TokenError       string     `json:"token_error,omitempty"`
+	TokenExpiresAt   *time.Time `json:"token_expires_at,omitempty"`
+	TokenExpired     bool       `json:"token_expired"`
+	LastRefresh      *time.Time `json:"last_refresh,omitempty"`
+	LastRefreshError string     `json:"last_refresh_error,omitempty"`
+	LastSuccess      *time.Time `json:"last_success,omitempty"`
+	LastFailure      *time.Time `json:"last_failure,omitempty"`
+	LastError        string     `json:"last_error,omitempty"`
+}
+
+// accountPool 可用的上游账号
+type accountPool struct {
+	mu       sync.Mutex
+	accounts []*account
+}
+
+// accounts 当前的账号池，目前只有 Kiro 默认 token 文件对应的账号
+var accounts = &accountPool{}
+
+// list 返回账号池中的账号，第一次调用时登记默认账号，调用方需持有 mu
+func (p *accountPool) list() []*account {
+	if p.accounts == nil {
+		p.accounts = []*account{{Name: defaultAccount, TokenPath: getTokenFilePath()}}
+	}
+	return p.accounts
+}
+
+// find 按名称查找账号，调用方需持有 mu
+func (p *accountPool) find(name string) *account {
+	for _, a := range p.list() {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// pick 返回第一个未停用的账号
+func (p *accountPool) pick() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, a := range p.list() {
+		if !a.disabled {
+			return a.Name, nil
+		}
+	}
+	return "", errors.New("all Kiro accounts are disabled")
+}
+
+// setDisabled 停用或启用账号
+func (p *accountPool) setDisabled(name string, disabled bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a := p.find(name)
+	if a == nil {
+		return fmt.Errorf("account %q not found", name)
+	}
+	a.disabled = disabled
+	return nil
+}
+
+// recordRefresh 记录一次 token 刷新的结果
+func (p *accountPool) recordRefresh(name string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a := p.find(name)
+	if a == nil {
+		return
+	}
+	a.lastRefresh = time.Now()
+	a.lastRefreshError = ""
+	if err != nil {
+		a.lastRefreshError = err.Error()
+	}
+}
+
+// recordUpstream 记录一次上游请求的结果，只有连接失败、认证失败、限流和服务端错误算作账号异常
+func (p *accountPool) recordUpstream(name string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	a := p.find(name)
+	if a == nil {
+		return
+	}
+	if !isAccountFailure(err) {
+		a.lastSuccess = time.Now()
+		return
+	}
+	a.lastFailure = time.Now()
+	a.lastError = err.Error()
+}
+
+// isAccountFailure 判断上游错误是否说明账号或上游服务异常，而不是请求本身有问题
+func isAccountFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		switch status := upstreamErr.StatusCode; {
+		case status == http.StatusUnauthorized, status == http.StatusForbidden,
+			status == http.StatusTooManyRequests, status >= http.StatusInternalServerError:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// snapshot 返回所有账号的状态，并读取 token 文件检查 token 是否存在和过期
+func (p *accountPool) snapshot() []accountStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var statuses []accountStatus
+	for _, a := range p.list() {
+		status := accountStatus{
+			Name:             a.Name,
+			Disabled:         a.disabled,
+			TokenPath:        a.TokenPath,
+			LastRefresh:      timeOrNil(a.lastRefresh),
+			LastRefreshError: a.lastRefreshError,
+			LastSuccess:      timeOrNil(a.lastSuccess),
+			LastFailure:      timeOrNil(a.lastFailure),
+			LastError:        a.lastError,
+		}
+
+		expiresAt, err := readTokenExpiry(a.TokenPath)
+		if err != nil {
+			status.TokenError = err.Error()
+		} else if !expiresAt.IsZero() {
+			status.TokenExpiresAt = &expiresAt
+			status.TokenExpired = !now.Before(expiresAt)
+		}
+
+		switch {
+		case a.disabled:
+			status.Health = "disabled"
+		case status.TokenError != "" || status.TokenExpired || a.lastFailure.After(a.lastSuccess):
+			status.Health = "unhealthy"
+		case a.lastSuccess.IsZero():
+			status.Health = "unknown"
+		default:
+			status.Health = "healthy"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// readTokenExpiry 读取 token 文件中的过期时间，token 文件没有过期时间时返回零值
+func readTokenExpiry(path string) (time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("读取token文件失败: %v", err)
+	}
+	var token TokenData
+	if err := jsonStr.Unmarshal(data, &token); err != nil {
+		return time.Time{}, fmt.Errorf("解析token文件失败: %v", err)
+	}
+	if token.AccessToken == "" {
+		return time.Time{}, errors.New("token文件中没有 accessToken")
+	}
+	if token.ExpiresAt == "" {
+		return time.Time{}, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, token.ExpiresAt)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("解析过期时间失败: %v", err)
+	}
+	return expiresAt, nil
+}
+
+// timeOrNil 零值时间返回 nil，使其在 JSON 中省略
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	jsonStr "encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recentLimit 最近错误和最近请求各保留的条数
+const recentLimit = 50
+
+// recentLog 保留最近 limit 条记录，超出后丢弃最早的记录
+type recentLog[T any] struct {
+	mu      sync.Mutex
+	limit   int
+	records []T
+	total   int
+}
+
+// newRecentLog 创建最多保留 limit 条记录的 recentLog
+func newRecentLog[T any](limit int) *recentLog[T] {
+	return &recentLog[T]{limit: limit}
+}
+
+// add 追加一条记录
+func (l *recentLog[T]) add(record T) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, record)
+	if len(l.records) > l.limit {
+		l.records = l.records[len(l.records)-l.limit:]
+	}
+	l.total++
+}
+
+// list 返回保留的记录，最新的在前
+func (l *recentLog[T]) list() []T {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := make([]T, len(l.records))
+	for i, record := range l.records {
+		records[len(l.records)-1-i] = record
+	}
+	return records
+}
+
+// count 返回累计追加的记录数
+func (l *recentLog[T]) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
+
+// errorRecord 返回给客户端的一个错误
+type errorRecord struct {
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request_id,omitempty"`
+	Status    int       `json:"status"`
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+}
+
+// recentErrors 最近返回给客户端的错误
+var recentErrors = newRecentLog[errorRecord](recentLimit)
+
+// recordError 记录返回给客户端的错误，请求 id 从响应头中读取
+func recordError(w http.ResponseWriter, apiErr *anthropicError) {
+	recentErrors.add(errorRecord{
+		Time:      time.Now(),
+		RequestId: w.Header().Get("request-id"),
+		Status:    apiErr.Status,
+		Type:      apiErr.Type,
+		Message:   apiErr.Message,
+	})
+}
+
+// requestRecord 一个已处理的 /v1/messages 请求
+type requestRecord struct {
+	Time         time.Time `json:"time"`
+	RequestId    string    `json:"request_id,omitempty"`
+	Client       string    `json:"client"`
+	Model        string    `json:"model"`
+	Account      string    `json:"account,omitempty"`
+	Status       int       `json:"status"`
+	LatencyMs    int64     `json:"latency_ms"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	StopReason   string    `json:"stop_reason,omitempty"`
+}
+
+// recentRequests 最近处理的 /v1/messages 请求
+var recentRequests = newRecentLog[requestRecord](recentLimit)
+
+// serverStartedAt 进程启动时间
+var serverStartedAt = time.Now()
+
+// registerAdminRoutes 注册管理接口
+func registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/status", logMiddleware(adminAuth(handleAdminStatus)))
+	mux.HandleFunc("GET /admin/config", logMiddleware(adminAuth(handleAdminConfig)))
+	mux.HandleFunc("GET /admin/errors", logMiddleware(adminAuth(handleAdminErrors)))
+	mux.HandleFunc("POST /admin/token/refresh", logMiddleware(adminAuth(handleAdminRefreshToken)))
+	mux.HandleFunc("POST /admin/config/reload", logMiddleware(adminAuth(handleAdminReloadConfig)))
+	mux.HandleFunc("POST /admin/accounts/{name}/disable", logMiddleware(adminAuth(handleAdminSetAccount(true))))
+	mux.HandleFunc("POST /admin/accounts/{name}/enable", logMiddleware(adminAuth(handleAdminSetAccount(false))))
+	mux.HandleFunc("POST /admin/streams/{id}/cancel", logMiddleware(adminAuth(handleAdminCancelStream)))
+}
+
+// generatedAdminToken 没有配置 admin.token 时启动服务器生成的管理 token
+var generatedAdminToken atomic.Pointer[string]
+
+// adminToken 返回访问管理接口需要的 token，配置文件中的 admin.token 优先，都没有时返回空字符串
+func adminToken() string {
+	if token := config().Admin.Token; token != "" {
+		return token
+	}
+	if token := generatedAdminToken.Load(); token != nil {
+		return *token
+	}
+	return ""
+}
+
+// getAdminTokenPath 返回生成的管理 token 的保存路径 ~/.kiro2cc/admin-token
+func getAdminTokenPath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".kiro2cc", "admin-token")
+}
+
+// ensureAdminToken 没有配置 admin.token 时读取 ~/.kiro2cc/admin-token 中保存的 token，
+// 文件不存在时生成一个随机 token 并保存，返回 token 和保存路径（使用配置中的 token 时路径为空）
+func ensureAdminToken() (string, string, error) {
+	if token := config().Admin.Token; token != "" {
+		return token, "", nil
+	}
+	path := getAdminTokenPath()
+	if path == "" {
+		return "", "", fmt.Errorf("无法确定管理 token 的保存路径")
+	}
+
+	data, err := os.ReadFile(path)
+	token := strings.TrimSpace(string(data))
+	if err != nil || token == "" {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return "", "", fmt.Errorf("生成管理 token 失败: %v", err)
+		}
+		token = hex.EncodeToString(b)
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return "", "", fmt.Errorf("保存管理 token 失败: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			return "", "", fmt.Errorf("保存管理 token 失败: %v", err)
+		}
+	}
+	generatedAdminToken.Store(&token)
+	return token, path, nil
+}
+
+// adminAuth 检查管理接口的访问权限：请求必须发往本机地址、不能来自其他网页，
+// 并携带管理 token（Authorization: Bearer 或 x-api-key）
+func adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Host 不是本机时可能是 DNS rebinding
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if !isLocalHost(host) {
+			writeAnthropicError(w, newAnthropicError(http.StatusForbidden, "Admin API only accepts requests addressed to localhost"))
+			return
+		}
+		// 浏览器中其他网页发起的跨域请求
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			writeAnthropicError(w, newAnthropicError(http.StatusForbidden, "Cross-origin admin requests are not allowed"))
+			return
+		}
+		if !hasAdminToken(r) {
+			writeAnthropicError(w, newAnthropicError(http.StatusUnauthorized, "Invalid admin token"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasAdminToken 返回请求是否带有正确的管理 token
+func hasAdminToken(r *http.Request) bool {
+	token := adminToken()
+	return token != "" && subtle.ConstantTimeCompare([]byte(clientKey(r)), []byte(token)) == 1
+}
+
+// writeJSON 以 JSON 格式返回响应
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := jsonStr.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// adminStatus 代理服务器的运行状态
+type adminStatus struct {
+	StartedAt        time.Time       `json:"started_at"`
+	UptimeSeconds    int64           `json:"uptime_seconds"`
+	Accounts         []accountStatus `json:"accounts"`
+	InFlightRequests map[string]int  `json:"in_flight_requests"`
+	Streams          []activeStream  `json:"streams"`
+	RequestsTotal    int             `json:"requests_total"` // 启动以来处理的 /v1/messages 请求数
+	RecentRequests   []requestRecord `json:"recent_requests"`
+	RecentErrors     []errorRecord   `json:"recent_errors"`
+}
+
+// currentStatus 汇总当前的运行状态
+func currentStatus() adminStatus {
+	inFlight := map[string]int{}
+	for endpoint, n := range requestsInFlight.snapshot() {
+		if n > 0 {
+			inFlight[endpoint] = int(n)
+		}
+	}
+	return adminStatus{
+		StartedAt:        serverStartedAt,
+		UptimeSeconds:    int64(time.Since(serverStartedAt).Seconds()),
+		Accounts:         accounts.snapshot(),
+		InFlightRequests: inFlight,
+		Streams:          activeStreams.list(),
+		RequestsTotal:    recentRequests.count(),
+		RecentRequests:   recentRequests.list(),
+		RecentErrors:     recentErrors.list(),
+	}
+}
+
+// handleAdminStatus 返回 token 和账号状态、进行中的请求、最近的请求和错误
+func handleAdminStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentStatus())
+}
+
+// handleAdminErrors 返回最近的错误
+func handleAdminErrors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, recentErrors.list())
+}
+
+// handleAdminConfig 返回当前生效的配置，其中的管理 token、代理密码和客户端 key 原文已隐藏
+func handleAdminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, redactConfig(config()))
+}
+
+// redactConfig 返回隐藏了管理 token、上游代理密码和预算中客户端 key 原文的配置副本
+func redactConfig(cfg *Config) Config {
+	redacted := *cfg
+	if redacted.Admin.Token != "" {
+		redacted.Admin.Token = "redacted"
+	}
+	redacted.Upstream.Proxy = redactURL(cfg.Upstream.Proxy)
+	if cfg.Budgets.Keys != nil {
+		redacted.Budgets.Keys = map[string]BudgetConfig{}
+		for key, budget := range cfg.Budgets.Keys {
+			if key != "*" && !strings.HasPrefix(key, "key-") {
+				key = clientLabel(key)
+			}
+			redacted.Budgets.Keys[key] = budget
+		}
+	}
+	return redacted
+}
+
+// handleAdminRefreshToken 立即刷新 token
+func handleAdminRefreshToken(w http.ResponseWriter, r *http.Request) {
+	token, err := refreshAccessToken()
+	if err != nil {
+		writeAnthropicError(w, newAnthropicError(http.StatusBadGateway, "%v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"account":    defaultAccount,
+		"refreshed":  true,
+		"expires_at": token.ExpiresAt,
+	})
+}
+
+// handleAdminReloadConfig 重新读取配置文件。服务器超时和链路追踪配置需要重启后生效
+func handleAdminReloadConfig(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadConfig()
+	if err == nil {
+		err = applyConfig(cfg)
+	}
+	if err != nil {
+		writeAnthropicError(w, newAnthropicError(http.StatusBadRequest, "%v", err))
+		return
+	}
+	fmt.Printf("已重新加载配置文件: %s\n", getConfigFilePath())
+	writeJSON(w, http.StatusOK, map[string]any{
+		"reloaded":         true,
+		"path":             getConfigFilePath(),
+		"restart_required": []string{"server", "tracing"},
+	})
+}
+
+// handleAdminSetAccount 停用或启用账号，停用的账号不再处理新请求
+func handleAdminSetAccount(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := accounts.setDisabled(name, disabled); err != nil {
+			writeAnthropicError(w, newAnthropicError(http.StatusNotFound, "%v", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"account": name, "disabled": disabled})
+	}
+}
+
+// handleAdminCancelStream 中断一个进行中的流式响应，客户端会收到一个 error 事件
+func handleAdminCancelStream(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !activeStreams.cancel(id, errStreamCancelled) {
+		writeAnthropicError(w, newAnthropicError(http.StatusNotFound, "Stream %s not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "cancelled": true})
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	jsonStr "encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// budgetWarningHeader 用量接近预算时返回的提醒响应头
+const budgetWarningHeader = "x-kiro2cc-budget-warning"
+
+// budgetUsage 一个客户端在当前自然日和自然月内已用的请求数和估算 token 数
+type budgetUsage struct {
+	Day           string `json:"day"`
+	DayRequests   int    `json:"day_requests"`
+	DayTokens     int    `json:"day_tokens"`
+	Month         string `json:"month"`
+	MonthRequests int    `json:"month_requests"`
+	MonthTokens   int    `json:"month_tokens"`
+}
+
+// roll 进入新的一天或新的一月时清零对应的计数
+func (u *budgetUsage) roll(now time.Time) {
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day, u.DayRequests, u.DayTokens = day, 0, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthRequests, u.MonthTokens = month, 0, 0
+	}
+}
+
+// budgetStore 持久化保存各客户端的预算计数，重启后继续累计
+type budgetStore struct {
+	mu       sync.Mutex
+	path     string
+	counters map[string]*budgetUsage
+	now      func() time.Time
+}
+
+// budgets 当前的预算计数
+var budgets = &budgetStore{now: time.Now}
+
+// getBudgetStorePath 返回预算计数文件路径，默认为 ~/.kiro2cc/budgets.json
+func getBudgetStorePath() string {
+	if path := config().Budgets.Store; path != "" {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".kiro2cc", "budgets.json")
+}
+
+// budgetFor 返回客户端的预算，依次按 key 原文、客户端标识和默认预算 "*" 查找
+func budgetFor(key, client string) (BudgetConfig, bool) {
+	keys := config().Budgets.Keys
+	for _, name := range []string{key, client, "*"} {
+		if name == "" {
+			continue
+		}
+		if budget, ok := keys[name]; ok {
+			return budget, true
+		}
+	}
+	return BudgetConfig{}, false
+}
+
+// load 在第一次使用或计数文件路径变化时读取计数文件，调用方需持有 mu
+func (s *budgetStore) load() error {
+	path := getBudgetStorePath()
+	if s.counters != nil && s.path == path {
+		return nil
+	}
+
+	counters := map[string]*budgetUsage{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("读取预算计数失败: %v", err)
+	}
+	if err == nil {
+		if err := jsonStr.Unmarshal(data, &counters); err != nil {
+			return fmt.Errorf("解析预算计数文件 %s 失败: %v", path, err)
+		}
+	}
+	s.path, s.counters = path, counters
+	return nil
+}
+
+// save 先写入临时文件再替换，避免写入中断损坏计数文件，调用方需持有 mu
+func (s *budgetStore) save() error {
+	data, err := jsonStr.MarshalIndent(s.counters, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// usage 返回客户端当前周期的计数，调用方需持有 mu
+func (s *budgetStore) usage(client string, now time.Time) *budgetUsage {
+	u := s.counters[client]
+	if u == nil {
+		u = &budgetUsage{}
+		s.counters[client] = u
+	}
+	u.roll(now)
+	return u
+}
+
+// budgetLimit 一项预算的用量和上限
+type budgetLimit struct {
+	name  string
+	used  int
+	limit int
+	reset time.Time
+}
+
+// budgetReservation 检查预算时预扣的一个请求和估算的输入 token，请求结束后通过 settle 结算
+type budgetReservation struct {
+	store  *budgetStore
+	client string
+	day    string
+	month  string
+	tokens int
+}
+
+// check 检查客户端是否已超出预算，未超出时在同一把锁内预扣一个请求和 estimatedTokens 个 token，
+// 避免并发请求同时通过检查后超出预算。返回接近预算时的提醒，客户端没有预算时 reservation 为 nil
+func (s *budgetStore) check(key, client string, estimatedTokens int) (warnings []string, reservation *budgetReservation, apiErr *anthropicError) {
+	budget, ok := budgetFor(key, client)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		// 计数不可用时不阻止请求
+		fmt.Printf("错误: %v\n", err)
+		return nil, nil, nil
+	}
+
+	now := s.now()
+	u := s.usage(client, now)
+	year, month, day := now.Date()
+	tomorrow := time.Date(year, month, day+1, 0, 0, 0, 0, now.Location())
+	nextMonth := time.Date(year, month+1, 1, 0, 0, 0, 0, now.Location())
+
+	for _, l := range []budgetLimit{
+		{"daily requests", u.DayRequests, budget.DailyRequests, tomorrow},
+		{"daily tokens", u.DayTokens, budget.DailyTokens, tomorrow},
+		{"monthly requests", u.MonthRequests, budget.MonthlyRequests, nextMonth},
+		{"monthly tokens", u.MonthTokens, budget.MonthlyTokens, nextMonth},
+	} {
+		if l.limit <= 0 {
+			continue
+		}
+		if l.used >= l.limit {
+			budgetExceededTotal.inc(l.name)
+			// 预算要到下一个周期才会恢复，使用客户端不会自动重试的状态码
+			return nil, nil, newAnthropicError(http.StatusForbidden,
+				"Budget exceeded for %s: %s used %d of %d, resets at %s",
+				client, l.name, l.used, l.limit, l.reset.Format(time.RFC3339))
+		}
+		if budget.SoftLimitPercent > 0 && l.used*100 >= l.limit*budget.SoftLimitPercent {
+			warnings = append(warnings, fmt.Sprintf("%s at %d%% (%d of %d)", l.name, l.used*100/l.limit, l.used, l.limit))
+		}
+	}
+
+	u.DayRequests++
+	u.DayTokens += estimatedTokens
+	u.MonthRequests++
+	u.MonthTokens += estimatedTokens
+	if err := s.save(); err != nil {
+		fmt.Printf("错误: 保存预算计数失败: %v\n", err)
+	}
+	return warnings, &budgetReservation{store: s, client: client, day: u.Day, month: u.Month, tokens: estimatedTokens}, nil
+}
+
+// settle 结算预扣的预算：请求成功完成时按实际的 token 数修正，否则退还预扣的请求和 token。
+// 预扣之后已进入新的一天或一月时，对应周期的计数已经清零，不再修正
+func (r *budgetReservation) settle(tokens int, completed bool) {
+	if r == nil {
+		return
+	}
+	s := r.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.load(); err != nil {
+		fmt.Printf("错误: %v\n", err)
+		return
+	}
+
+	requests, delta := 0, tokens-r.tokens
+	if !completed {
+		requests, delta = -1, -r.tokens
+	}
+	u := s.usage(r.client, s.now())
+	if u.Day == r.day {
+		u.DayRequests = max(u.DayRequests+requests, 0)
+		u.DayTokens = max(u.DayTokens+delta, 0)
+	}
+	if u.Month == r.month {
+		u.MonthRequests = max(u.MonthRequests+requests, 0)
+		u.MonthTokens = max(u.MonthTokens+delta, 0)
+	}
+	if err := s.save(); err != nil {
+		fmt.Printf("错误: 保存预算计数失败: %v\n", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setBudgets 在测试期间使用指定的预算和临时计数文件
+func setBudgets(t *testing.T, keys map[string]BudgetConfig) string {
+	t.Helper()
+
+	store := filepath.Join(t.TempDir(), "budgets.json")
+	cfg := defaultConfig()
+	cfg.Budgets = BudgetsConfig{Store: store, Keys: keys}
+	previous := currentConfig.Swap(cfg)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+	return store
+}
+
+func TestBudgetStore(t *testing.T) {
+	setBudgets(t, map[string]BudgetConfig{
+		"team-key": {DailyRequests: 2, MonthlyTokens: 1000, SoftLimitPercent: 50},
+	})
+	now := time.Date(2025, 3, 31, 12, 0, 0, 0, time.Local)
+	s := &budgetStore{now: func() time.Time { return now }}
+	client := clientLabel("team-key")
+
+	warnings, reservation, err := s.check("team-key", client, 100)
+	if err != nil || len(warnings) != 0 {
+		t.Fatalf("first check = %v, %v", warnings, err)
+	}
+	reservation.settle(600, true)
+
+	warnings, reservation, err = s.check("team-key", client, 100)
+	if err != nil || len(warnings) != 2 {
+		t.Fatalf("warnings = %q, err = %v, want 2 warnings", warnings, err)
+	}
+	reservation.settle(100, true)
+
+	_, _, err = s.check("team-key", client, 100)
+	if err == nil || err.Status != http.StatusForbidden || err.Type != "permission_error" || !strings.Contains(err.Message, "daily requests used 2 of 2") {
+		t.Fatalf("err = %v, want non-retryable daily requests exceeded", err)
+	}
+	if u := s.counters[client]; u.DayRequests != 2 || u.MonthTokens != 700 {
+		t.Fatalf("usage = %+v, want 2 requests and 700 tokens", u)
+	}
+
+	// 重新读取计数文件，模拟重启
+	restarted := &budgetStore{now: func() time.Time { return now.Add(13 * time.Hour) }}
+	_, reservation, err = restarted.check("team-key", client, 100)
+	if err != nil {
+		t.Fatalf("new day rejected: %v", err)
+	}
+	reservation.settle(300, true)
+	_, reservation, err = restarted.check("team-key", client, 100)
+	if err != nil {
+		t.Fatalf("new month rejected: %v", err)
+	}
+	// 失败的请求退还预扣的请求和 token
+	reservation.settle(0, false)
+	if u := restarted.counters[client]; u.DayRequests != 1 || u.MonthTokens != 300 {
+		t.Fatalf("usage after refund = %+v, want 1 request and 300 tokens", u)
+	}
+
+	// 没有预算的客户端不计数
+	if _, reservation, _ := s.check("other-key", clientLabel("other-key"), 100); reservation != nil {
+		t.Fatal("client without a budget was reserved")
+	}
+}
+
+func TestBudgetReservationIsAtomic(t *testing.T) {
+	setBudgets(t, map[string]BudgetConfig{"*": {DailyRequests: 5}})
+	s := &budgetStore{now: time.Now}
+
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := s.check("team-key", clientLabel("team-key"), 10); err == nil {
+				accepted.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := accepted.Load(); got != 5 {
+		t.Fatalf("accepted %d concurrent requests, want 5", got)
+	}
+}
+
+func TestHandleMessagesOverBudget(t *testing.T) {
+	setupFakeUpstream(t)
+	setBudgets(t, map[string]BudgetConfig{"*": {DailyRequests: 1}})
+	previous := budgets
+	budgets = &budgetStore{now: time.Now}
+	defer func() { budgets = previous }()
+
+	req := messagesRequest(false)
+	req.Header.Set("x-api-key", "team-key")
+	rec := httptest.NewRecorder()
+	handleMessages(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d", rec.Code)
+	}
+
+	req = messagesRequest(true)
+	req.Header.Set("x-api-key", "team-key")
+	rec = httptest.NewRecorder()
+	handleMessages(rec, req)
+	checkErrorResponse(t, rec, http.StatusForbidden, "permission_error")
+	if rec.Header().Get("retry-after") != "" {
+		t.Fatal("budget errors must not ask the client to retry")
+	}
+}
+
+func TestOverBudgetRequestsKeepRateAllowance(t *testing.T) {
+	setupFakeUpstream(t)
+	setBudgets(t, map[string]BudgetConfig{"*": {DailyRequests: 1}})
+	previous := budgets
+	budgets = &budgetStore{now: time.Now}
+	defer func() { budgets = previous }()
+	previousLimiter := currentRateLimiter.Swap(newRateLimiter(RateLimitConfig{PerClient: LimitConfig{RequestsPerMinute: 2}}))
+	defer currentRateLimiter.Store(previousLimiter)
+
+	for i, want := range []int{http.StatusOK, http.StatusForbidden, http.StatusForbidden} {
+		req := messagesRequest(false)
+		req.Header.Set("x-api-key", "team-key")
+		rec := httptest.NewRecorder()
+		handleMessages(rec, req)
+		if rec.Code != want {
+			t.Fatalf("request %d status = %d, want %d", i, rec.Code, want)
+		}
+	}
+
+	// 被预算拒绝的请求没有占用限流额度
+	release, _, limitErr := activeRateLimiter().acquire(clientLabel("team-key"), 0)
+	if limitErr != nil {
+		t.Fatalf("rate allowance consumed by rejected requests: %+v", limitErr)
+	}
+	release(0)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	jsonStr "encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// configEnv 指定配置文件路径的环境变量
+const configEnv = "KIRO2CC_CONFIG"
+
+// Config 表示 kiro2cc 的配置，未配置的字段使用默认值
+type Config struct {
+	Server    ServerConfig    `json:"server"`
+	Retry     RetryConfig     `json:"retry"`
+	Upstream  UpstreamConfig  `json:"upstream"`
+	Tracing   TracingConfig   `json:"tracing"`
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	Usage     UsageConfig     `json:"usage"`
+	Budgets   BudgetsConfig   `json:"budgets"`
+	Admin     AdminConfig     `json:"admin"`
+	Health    HealthConfig    `json:"health"`
+}
+
+// HealthConfig 就绪检查配置
+type HealthConfig struct {
+	Probe        bool     `json:"probe"`         // 每次就绪检查都实际连接上游服务
+	ProbeTimeout Duration `json:"probe_timeout"` // 连接上游服务的超时
+}
+
+// AdminConfig 管理接口配置
+type AdminConfig struct {
+	Token string `json:"token"` // 访问 /admin 需要的 Bearer token，为空时启动服务器生成一个并保存在 ~/.kiro2cc/admin-token
+}
+
+// BudgetsConfig 客户端预算配置
+type BudgetsConfig struct {
+	Store string                  `json:"store"` // 预算计数文件，默认为 ~/.kiro2cc/budgets.json
+	Keys  map[string]BudgetConfig `json:"keys"`  // 以客户端 key 原文或 key-xxxxxxxx 标识为键，"*" 为其他客户端的默认预算
+}
+
+// BudgetConfig 一个客户端按自然日和自然月计算的预算，0 表示不限制
+type BudgetConfig struct {
+	DailyRequests    int `json:"daily_requests"`
+	DailyTokens      int `json:"daily_tokens"` // 估算的输入和输出 token 合计
+	MonthlyRequests  int `json:"monthly_requests"`
+	MonthlyTokens    int `json:"monthly_tokens"`
+	SoftLimitPercent int `json:"soft_limit_percent"` // 用量达到预算的该百分比时在响应头中提醒
+}
+
+// UsageConfig 用量账本配置
+type UsageConfig struct {
+	Ledger   string `json:"ledger"`   // 账本路径，默认为 ~/.kiro2cc/usage.jsonl
+	Disabled bool   `json:"disabled"` // 不记录用量
+}
+
+// ServerConfig 代理服务器配置
+type ServerConfig struct {
+	ReadHeaderTimeout Duration `json:"read_header_timeout"`
+	ReadTimeout       Duration `json:"read_timeout"`     // 读取整个请求（包括请求体）的时间
+	WriteTimeout      Duration `json:"write_timeout"`    // 写出整个响应的时间，流式响应可能持续数分钟，默认不限制
+	IdleTimeout       Duration `json:"idle_timeout"`     // keep-alive 连接的空闲时间
+	ShutdownTimeout   Duration `json:"shutdown_timeout"` // 退出时等待进行中的请求结束的时间
+}
+
+// RetryConfig 上游请求重试配置，只重试还没有开始向客户端输出的请求
+type RetryConfig struct {
+	MaxRetries     int      `json:"max_retries"`     // 每个请求最多重试次数
+	InitialBackoff Duration `json:"initial_backoff"` // 第一次重试前的等待时间
+	MaxBackoff     Duration `json:"max_backoff"`     // 单次等待时间上限
+	Deadline       Duration `json:"deadline"`        // 从第一次请求开始计算的重试总时限
+}
+
+// UpstreamConfig 访问 CodeWhisperer 和 Kiro 认证服务的 HTTP 客户端配置
+type UpstreamConfig struct {
+	DialTimeout           Duration `json:"dial_timeout"`
+	TLSHandshakeTimeout   Duration `json:"tls_handshake_timeout"`
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"` // 发出请求后等待响应头的时间
+	IdleConnTimeout       Duration `json:"idle_conn_timeout"`       // 空闲连接保留时间
+	MaxIdleConnsPerHost   int      `json:"max_idle_conns_per_host"`
+	Proxy                 string   `json:"proxy"`     // 代理地址，为空时使用 HTTPS_PROXY/NO_PROXY 环境变量
+	CABundle              string   `json:"ca_bundle"` // PEM 格式的额外根证书文件，用于 TLS 检查代理
+}
+
+// RateLimitConfig 限流配置，per_client 对每个客户端 key 分别生效，global 对所有请求合计生效
+type RateLimitConfig struct {
+	PerClient LimitConfig `json:"per_client"`
+	Global    LimitConfig `json:"global"`
+}
+
+// LimitConfig 一个范围内的限额，0 表示不限制
+type LimitConfig struct {
+	RequestsPerMinute int `json:"requests_per_minute"`
+	TokensPerMinute   int `json:"tokens_per_minute"` // 估算的输入和输出 token 合计
+	MaxConcurrent     int `json:"max_concurrent"`    // 同时进行的请求数，包括流式响应
+}
+
+// TracingConfig 链路追踪配置
+type TracingConfig struct {
+	Exporter     string `json:"exporter"`      // 为空时不记录，可选 stdout、file、otlp
+	File         string `json:"file"`          // exporter 为 file 时写入的文件，每行一个 span
+	OTLPEndpoint string `json:"otlp_endpoint"` // OTLP/HTTP collector 地址，如 http://localhost:4318
+	ServiceName  string `json:"service_name"`
+}
+
+// Duration 以 "500ms"、"30s" 这样的字符串配置的时间间隔
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return jsonStr.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := jsonStr.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// defaultConfig 返回默认配置
+func defaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			ReadHeaderTimeout: Duration(10 * time.Second),
+			ReadTimeout:       Duration(time.Minute),
+			IdleTimeout:       Duration(2 * time.Minute),
+			ShutdownTimeout:   Duration(30 * time.Second),
+		},
+		Retry: RetryConfig{
+			MaxRetries:     3,
+			InitialBackoff: Duration(500 * time.Millisecond),
+			MaxBackoff:     Duration(8 * time.Second),
+			Deadline:       Duration(30 * time.Second),
+		},
+		Upstream: UpstreamConfig{
+			DialTimeout:           Duration(10 * time.Second),
+			TLSHandshakeTimeout:   Duration(10 * time.Second),
+			ResponseHeaderTimeout: Duration(2 * time.Minute),
+			IdleConnTimeout:       Duration(90 * time.Second),
+			MaxIdleConnsPerHost:   16,
+		},
+		Tracing: TracingConfig{
+			ServiceName: "kiro2cc",
+		},
+		Health: HealthConfig{
+			ProbeTimeout: Duration(5 * time.Second),
+		},
+	}
+}
+
+// currentConfig 当前生效的配置
+var currentConfig atomic.Pointer[Config]
+
+// config 返回当前生效的配置，未加载配置文件时返回默认配置
+func config() *Config {
+	if cfg := currentConfig.Load(); cfg != nil {
+		return cfg
+	}
+	return defaultConfig()
+}
+
+// getConfigFilePath 返回配置文件路径，默认为 ~/.kiro2cc/config.json
+func getConfigFilePath() string {
+	if path := os.Getenv(configEnv); path != "" {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".kiro2cc", "config.json")
+}
+
+// loadConfig 读取配置文件并覆盖默认值，文件不存在时使用默认配置
+func loadConfig() (*Config, error) {
+	cfg := defaultConfig()
+
+	path := getConfigFilePath()
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取配置文件失败: %v", err)
+	}
+	if err := jsonStr.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("解析配置文件 %s 失败: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// applyConfig 使配置生效，并按配置重新创建上游 HTTP 客户端
+func applyConfig(cfg *Config) error {
+	client, err := newUpstreamClient(cfg.Upstream)
+	if err != nil {
+		return fmt.Errorf("上游 HTTP 客户端配置错误: %v", err)
+	}
+	currentConfig.Store(cfg)
+	sharedUpstreamClient.Store(client)
+	currentRateLimiter.Store(newRateLimiter(cfg.RateLimit))
+	return nil
+}
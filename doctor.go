@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	jsonStr "encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// doctorTimeout 诊断时每个网络请求的超时
+const doctorTimeout = 5 * time.Second
+
+// runDoctor 实现 kiro2cc doctor 命令，返回是否所有检查都没有失败
+func runDoctor(args []string, stdout io.Writer) (bool, error) {
+	flags := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	port := flags.String("port", "8080", "代理服务器端口")
+	format := flags.String("format", "text", "输出格式: text、json")
+	if err := flags.Parse(args); err != nil {
+		return false, err
+	}
+
+	// 配置文件有错误时使用默认配置继续诊断，错误在 config 检查中报告
+	cfg, err := loadConfig()
+	if err == nil {
+		err = applyConfig(cfg)
+	}
+
+	report := doctorReport(*port, err)
+	switch *format {
+	case "json":
+		encoder := jsonStr.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return false, err
+		}
+	case "text":
+		writeDoctorText(stdout, report)
+	default:
+		return false, fmt.Errorf("未知的输出格式: %s", *format)
+	}
+	return report.Status != healthFail, nil
+}
+
+// doctorReport 依次执行所有诊断检查，configErr 为加载配置文件时的错误
+func doctorReport(port string, configErr error) healthReport {
+	checks := []healthCheck{checkConfig(getConfigFilePath(), configErr)}
+	token, tokenChecks := checkTokenFile(getTokenFilePath(), time.Now())
+	checks = append(checks, tokenChecks...)
+	checks = append(checks, checkRefreshDryRun(token))
+	checks = append(checks, checkPortAndServer(port)...)
+	checks = append(checks, checkClientEnv(port), checkClaudeConfig(), checkProxySettings())
+	return newHealthReport(checks...)
+}
+
+// checkConfig 报告配置文件能否加载，err 为加载或应用配置时的错误
+func checkConfig(path string, err error) healthCheck {
+	check := healthCheck{Name: "config", Detail: map[string]any{"path": path}}
+	if err != nil {
+		check.Status, check.Message = healthFail, err.Error()
+		check.Fix = fmt.Sprintf("修正配置文件中的错误（JSON 格式、upstream.proxy、upstream.ca_bundle 等），或设置 %s 指向其他配置文件；本次诊断使用默认配置", configEnv)
+		return check
+	}
+	if _, statErr := os.Stat(path); statErr != nil {
+		check.Status, check.Message = healthPass, fmt.Sprintf("没有配置文件 %s，使用默认配置", path)
+		return check
+	}
+	check.Status, check.Message = healthPass, fmt.Sprintf("已加载配置文件 %s", path)
+	return check
+}
+
+// writeDoctorText 以便于阅读的格式输出诊断结果
+func writeDoctorText(w io.Writer, report healthReport) {
+	marks := map[string]string{healthPass: "[ OK ]", healthWarn: "[WARN]", healthFail: "[FAIL]"}
+	for _, check := range report.Checks {
+		fmt.Fprintf(w, "%s %-14s %s\n", marks[check.Status], check.Name, check.Message)
+		if check.Fix != "" && check.Status != healthPass {
+			fmt.Fprintf(w, "       %-14s 修复: %s\n", "", check.Fix)
+		}
+	}
+
+	failed, warned := 0, 0
+	for _, check := range report.Checks {
+		switch check.Status {
+		case healthFail:
+			failed++
+		case healthWarn:
+			warned++
+		}
+	}
+	fmt.Fprintln(w)
+	if failed == 0 && warned == 0 {
+		fmt.Fprintln(w, "一切正常")
+		return
+	}
+	fmt.Fprintf(w, "%d 项失败，%d 项警告\n", failed, warned)
+}
+
+// checkTokenFile 检查 token 文件的位置、权限、内容和过期时间，返回读取到的 token
+func checkTokenFile(path string, now time.Time) (TokenData, []healthCheck) {
+	file := healthCheck{Name: "token_file", Detail: map[string]any{"path": path}}
+	info, err := os.Stat(path)
+	if err != nil {
+		file.Status, file.Message = healthFail, fmt.Sprintf("找不到 token 文件 %s", path)
+		file.Fix = "安装 Kiro 并登录，登录后会生成该文件"
+		return TokenData{}, []healthCheck{file}
+	}
+	mode := info.Mode().Perm()
+	file.Detail["mode"] = fmt.Sprintf("%04o", mode)
+	file.Status, file.Message = healthPass, fmt.Sprintf("%s (%04o)", path, mode)
+	if runtime.GOOS != "windows" && mode&0077 != 0 {
+		file.Status, file.Message = healthWarn, fmt.Sprintf("%s 权限为 %04o，其他用户可以读取 token", path, mode)
+		file.Fix = "chmod 600 " + path
+	}
+
+	content := healthCheck{Name: "token_json"}
+	var token TokenData
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = jsonStr.Unmarshal(data, &token)
+	}
+	switch {
+	case err != nil:
+		content.Status, content.Message = healthFail, fmt.Sprintf("无法解析 token 文件: %v", err)
+		content.Fix = "在 Kiro 中重新登录以重新生成 token 文件"
+		return TokenData{}, []healthCheck{file, content}
+	case token.AccessToken == "" || token.RefreshToken == "":
+		content.Status, content.Message = healthFail, "token 文件中缺少 accessToken 或 refreshToken"
+		content.Fix = "在 Kiro 中重新登录以重新生成 token 文件"
+		return token, []healthCheck{file, content}
+	}
+	content.Status, content.Message = healthPass, "token 文件格式正确"
+
+	expiry := healthCheck{Name: "token_expiry"}
+	if token.ExpiresAt == "" {
+		expiry.Status, expiry.Message = healthWarn, "token 文件中没有过期时间"
+		expiry.Fix = "运行 kiro2cc refresh 刷新 token"
+		return token, []healthCheck{file, content, expiry}
+	}
+	expiresAt, err := time.Parse(time.RFC3339, token.ExpiresAt)
+	if err != nil {
+		expiry.Status, expiry.Message = healthWarn, fmt.Sprintf("无法解析过期时间 %q", token.ExpiresAt)
+		expiry.Fix = "运行 kiro2cc refresh 刷新 token"
+		return token, []healthCheck{file, content, expiry}
+	}
+	expiry.Detail = map[string]any{"expires_at": expiresAt}
+	switch left := expiresAt.Sub(now); {
+	case left <= 0:
+		expiry.Status, expiry.Message = healthFail, fmt.Sprintf("token 已于 %s 过期", expiresAt.Local().Format(time.DateTime))
+		expiry.Fix = "运行 kiro2cc refresh 刷新 token"
+	case left < tokenExpiryWarning:
+		expiry.Status, expiry.Message = healthWarn, fmt.Sprintf("token 将在 %v 后过期", left.Round(time.Second))
+		expiry.Fix = "运行 kiro2cc refresh 刷新 token"
+	default:
+		expiry.Status, expiry.Message = healthPass, fmt.Sprintf("token 有效期至 %s", expiresAt.Local().Format(time.DateTime))
+	}
+	return token, []healthCheck{file, content, expiry}
+}
+
+// checkRefreshDryRun 检查能否刷新 token。只连接刷新服务，不发送 refresh token，
+// 避免刷新后旧的 refresh token 失效
+func checkRefreshDryRun(token TokenData) healthCheck {
+	check := healthCheck{Name: "token_refresh", Detail: map[string]any{"url": refreshTokenURL}}
+	if token.RefreshToken == "" {
+		check.Status, check.Message = healthFail, "没有可用的 refresh token，无法刷新"
+		check.Fix = "在 Kiro 中重新登录"
+		return check
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, refreshTokenURL, nil)
+	if err != nil {
+		check.Status, check.Message = healthFail, err.Error()
+		return check
+	}
+	resp, err := upstreamClient().Do(req)
+	if err != nil {
+		check.Status, check.Message = healthFail, fmt.Sprintf("无法连接 token 刷新服务: %v", err)
+		check.Fix = "检查网络连接和代理设置（见 proxy 检查），公司代理需要在配置文件中设置 upstream.proxy 和 upstream.ca_bundle"
+		return check
+	}
+	resp.Body.Close()
+	check.Status, check.Message = healthPass, "token 刷新服务可达（未实际刷新）"
+	return check
+}
+
+// checkPortAndServer 检查代理端口是否可用以及是否已有代理服务器在运行，
+// 已在运行时读取其 /health/ready 结果
+func checkPortAndServer(port string) []healthCheck {
+	portCheck := healthCheck{Name: "port", Detail: map[string]any{"port": port}}
+	server := healthCheck{Name: "server"}
+
+	listener, err := net.Listen("tcp", ":"+port)
+	if err == nil {
+		listener.Close()
+		portCheck.Status, portCheck.Message = healthPass, fmt.Sprintf("端口 %s 可用", port)
+		server.Status, server.Message = healthWarn, "代理服务器未运行"
+		server.Fix = "运行 kiro2cc server " + port
+		return []healthCheck{portCheck, server}
+	}
+
+	report, readyErr := fetchReadiness("http://127.0.0.1:" + port + "/health/ready")
+	if readyErr != nil {
+		portCheck.Status, portCheck.Message = healthFail, fmt.Sprintf("端口 %s 已被其他程序占用", port)
+		portCheck.Fix = "关闭占用端口的程序，或使用 kiro2cc server <其他端口> 并相应修改 ANTHROPIC_BASE_URL"
+		server.Status, server.Message = healthWarn, "代理服务器未运行"
+		return []healthCheck{portCheck, server}
+	}
+
+	portCheck.Status, portCheck.Message = healthPass, fmt.Sprintf("端口 %s 由正在运行的 kiro2cc 使用", port)
+	server.Detail = map[string]any{"readiness": report}
+	server.Status = report.Status
+	var problems []string
+	for _, check := range report.Checks {
+		if check.Status != healthPass {
+			problems = append(problems, check.Name+": "+check.Message)
+		}
+	}
+	if len(problems) == 0 {
+		server.Message = "代理服务器正在运行，就绪检查通过"
+		return []healthCheck{portCheck, server}
+	}
+	server.Message = "代理服务器正在运行，就绪检查: " + strings.Join(problems, "; ")
+	server.Fix = "查看 http://127.0.0.1:" + port + "/ui 或 /admin/status"
+	return []healthCheck{portCheck, server}
+}
+
+// fetchReadiness 读取正在运行的代理服务器的就绪检查结果
+func fetchReadiness(url string) (healthReport, error) {
+	client := &http.Client{Timeout: doctorTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return healthReport{}, err
+	}
+	defer resp.Body.Close()
+
+	var report healthReport
+	if err := jsonStr.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return healthReport{}, err
+	}
+	if len(report.Checks) == 0 {
+		return healthReport{}, fmt.Errorf("不是 kiro2cc 的就绪检查响应")
+	}
+	return report, nil
+}
+
+// checkClientEnv 检查 Claude Code 使用的 ANTHROPIC_BASE_URL 和 ANTHROPIC_API_KEY 是否指向本地代理
+func checkClientEnv(port string) healthCheck {
+	baseURL := os.Getenv("ANTHROPIC_BASE_URL")
+	check := healthCheck{Name: "client_env", Detail: map[string]any{
+		"ANTHROPIC_BASE_URL":       baseURL,
+		"ANTHROPIC_API_KEY_set":    os.Getenv("ANTHROPIC_API_KEY") != "",
+		"ANTHROPIC_AUTH_TOKEN_set": os.Getenv("ANTHROPIC_AUTH_TOKEN") != "",
+	}}
+	fix := "运行 eval $(kiro2cc export)"
+	if runtime.GOOS == "windows" {
+		fix = "运行 kiro2cc export 并执行输出的命令"
+	}
+	want := "http://localhost:" + port
+
+	if baseURL == "" {
+		check.Status, check.Message, check.Fix = healthWarn, "没有设置 ANTHROPIC_BASE_URL，客户端会直接访问 Anthropic", fix
+		return check
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil || !isLocalHost(u.Hostname()) || u.Port() != port {
+		check.Status, check.Message = healthWarn, fmt.Sprintf("ANTHROPIC_BASE_URL=%s，没有指向本地代理 %s", baseURL, want)
+		check.Fix = fix
+		return check
+	}
+	if os.Getenv("ANTHROPIC_API_KEY") == "" && os.Getenv("ANTHROPIC_AUTH_TOKEN") == "" {
+		check.Status, check.Message, check.Fix = healthWarn, "没有设置 ANTHROPIC_API_KEY", fix
+		return check
+	}
+	check.Status, check.Message = healthPass, "ANTHROPIC_BASE_URL 指向本地代理，已设置 API key"
+	return check
+}
+
+// isLocalHost 判断主机名是否为本机
+func isLocalHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkClaudeConfig 检查 ~/.claude.json 是否存在以及是否已由 kiro2cc claude 设置
+func checkClaudeConfig() healthCheck {
+	check := healthCheck{Name: "claude_config"}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		check.Status, check.Message = healthFail, fmt.Sprintf("获取用户目录失败: %v", err)
+		return check
+	}
+	path := filepath.Join(homeDir, ".claude.json")
+	check.Detail = map[string]any{"path": path}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		check.Status, check.Message = healthWarn, fmt.Sprintf("找不到 Claude 配置文件 %s", path)
+		check.Fix = "安装 Claude Code（npm install -g @anthropic-ai/claude-code）并运行一次，然后运行 kiro2cc claude"
+		return check
+	}
+	var claudeConfig map[string]any
+	if err := jsonStr.Unmarshal(data, &claudeConfig); err != nil {
+		check.Status, check.Message = healthFail, fmt.Sprintf("无法解析 %s: %v", path, err)
+		check.Fix = "修复或删除该文件后重新运行 Claude Code 和 kiro2cc claude"
+		return check
+	}
+	if claudeConfig["kiro2cc"] != true || claudeConfig["hasCompletedOnboarding"] != true {
+		check.Status, check.Message = healthWarn, "Claude 配置文件尚未由 kiro2cc 设置，Claude Code 可能会要求登录"
+		check.Fix = "运行 kiro2cc claude"
+		return check
+	}
+	check.Status, check.Message = healthPass, path+" 已由 kiro2cc 设置"
+	return check
+}
+
+// checkProxySettings 报告访问上游时使用的代理和 CA 证书设置
+func checkProxySettings() healthCheck {
+	cfg := config().Upstream
+	check := healthCheck{Name: "proxy", Detail: map[string]any{}}
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy", "NO_PROXY", "no_proxy"} {
+		if value := os.Getenv(name); value != "" {
+			check.Detail[name] = redactURL(value)
+		}
+	}
+	if cfg.Proxy != "" {
+		check.Detail["upstream.proxy"] = redactURL(cfg.Proxy)
+	}
+	if cfg.CABundle != "" {
+		check.Detail["upstream.ca_bundle"] = cfg.CABundle
+	}
+
+	client, err := newUpstreamClient(cfg)
+	if err != nil {
+		check.Status, check.Message = healthFail, err.Error()
+		check.Fix = "检查配置文件 " + getConfigFilePath() + " 中的 upstream.proxy 和 upstream.ca_bundle"
+		return check
+	}
+	req, _ := http.NewRequest(http.MethodPost, codeWhispererURL, nil)
+	proxyURL, err := client.Transport.(*http.Transport).Proxy(req)
+	if err != nil {
+		check.Status, check.Message = healthFail, fmt.Sprintf("代理设置无效: %v", err)
+		check.Fix = "检查 HTTPS_PROXY 环境变量或配置文件中的 upstream.proxy"
+		return check
+	}
+
+	check.Status = healthPass
+	if proxyURL == nil {
+		check.Message = "直接连接上游，没有使用代理"
+	} else {
+		check.Message = "通过代理 " + proxyURL.Redacted() + " 连接上游"
+	}
+	if cfg.CABundle != "" {
+		check.Message += "，额外信任 " + cfg.CABundle + " 中的证书"
+	}
+	return check
+}
+
+// redactURL 隐藏代理地址中的密码
+func redactURL(value string) string {
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		return u.Redacted()
+	}
+	return value
+}
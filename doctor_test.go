@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	jsonStr "encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkStatuses 返回各项检查的结果，便于比较
+func checkStatuses(checks []healthCheck) map[string]string {
+	statuses := map[string]string{}
+	for _, check := range checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+func TestCheckTokenFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kiro-auth-token.json")
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	_, checks := checkTokenFile(path, now)
+	if got := checkStatuses(checks); len(got) != 1 || got["token_file"] != healthFail {
+		t.Fatalf("missing file = %v", got)
+	}
+
+	os.WriteFile(path, []byte(`{"accessToken":`), 0600)
+	_, checks = checkTokenFile(path, now)
+	if got := checkStatuses(checks); got["token_file"] != healthPass || got["token_json"] != healthFail {
+		t.Fatalf("invalid json = %v", got)
+	}
+
+	os.WriteFile(path, []byte(`{"accessToken":"a","refreshToken":"r","expiresAt":"2025-03-01T11:00:00Z"}`), 0644)
+	os.Chmod(path, 0644)
+	token, checks := checkTokenFile(path, now)
+	got := checkStatuses(checks)
+	if token.RefreshToken != "r" || got["token_json"] != healthPass || got["token_expiry"] != healthFail {
+		t.Fatalf("expired token = %v", got)
+	}
+	if runtime.GOOS != "windows" && (got["token_file"] != healthWarn || !strings.Contains(checks[0].Fix, "chmod 600")) {
+		t.Fatalf("readable token file = %+v", checks[0])
+	}
+
+	_, checks = checkTokenFile(path, now.Add(-2*time.Hour))
+	if got := checkStatuses(checks); got["token_expiry"] != healthPass {
+		t.Fatalf("valid token = %v", got)
+	}
+}
+
+func TestCheckPortAndServer(t *testing.T) {
+	setupFakeUpstream(t)
+	writeTestToken(t, time.Now().Add(time.Hour))
+	adminServer(t, defaultConfig())
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	// 端口被其他程序占用
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	_, otherPort, _ := net.SplitHostPort(other.Listener.Addr().String())
+	checks := checkPortAndServer(otherPort)
+	if got := checkStatuses(checks); got["port"] != healthFail {
+		t.Fatalf("port used by another program = %v", got)
+	}
+
+	server := newServer("", defaultConfig().Server)
+	go server.Serve(listener)
+	defer server.Close()
+	checks = checkPortAndServer(port)
+	if got := checkStatuses(checks); got["port"] != healthPass || got["server"] != healthPass {
+		t.Fatalf("running server = %+v", checks)
+	}
+
+	server.Close()
+	checks = checkPortAndServer(port)
+	if got := checkStatuses(checks); got["port"] != healthPass || got["server"] != healthWarn {
+		t.Fatalf("stopped server = %+v", checks)
+	}
+}
+
+func TestCheckClientEnvAndClaudeConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+
+	t.Setenv("ANTHROPIC_BASE_URL", "")
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	t.Setenv("ANTHROPIC_AUTH_TOKEN", "")
+	if check := checkClientEnv("8080"); check.Status != healthWarn || check.Fix == "" {
+		t.Fatalf("unset env = %+v", check)
+	}
+	t.Setenv("ANTHROPIC_BASE_URL", "http://localhost:9090")
+	t.Setenv("ANTHROPIC_API_KEY", "key")
+	if check := checkClientEnv("8080"); check.Status != healthWarn {
+		t.Fatalf("wrong port = %+v", check)
+	}
+	t.Setenv("ANTHROPIC_BASE_URL", "http://127.0.0.1:8080")
+	if check := checkClientEnv("8080"); check.Status != healthPass {
+		t.Fatalf("local proxy = %+v", check)
+	}
+
+	if check := checkClaudeConfig(); check.Status != healthWarn {
+		t.Fatalf("missing .claude.json = %+v", check)
+	}
+	claudePath := filepath.Join(home, ".claude.json")
+	os.WriteFile(claudePath, []byte(`{"numStartups": 3}`), 0644)
+	if check := checkClaudeConfig(); check.Status != healthWarn || check.Fix != "运行 kiro2cc claude" {
+		t.Fatalf(".claude.json without flag = %+v", check)
+	}
+	os.WriteFile(claudePath, []byte(`{"hasCompletedOnboarding": true, "kiro2cc": true}`), 0644)
+	if check := checkClaudeConfig(); check.Status != healthPass {
+		t.Fatalf(".claude.json set by kiro2cc = %+v", check)
+	}
+}
+
+func TestRunDoctorJSON(t *testing.T) {
+	setupFakeUpstream(t)
+	refresh := httptest.NewServer(http.NotFoundHandler())
+	defer refresh.Close()
+	originalURL := refreshTokenURL
+	refreshTokenURL = refresh.URL
+	defer func() { refreshTokenURL = originalURL }()
+
+	// runDoctor 会加载并应用配置文件
+	previousConfig, previousClient, previousLimiter := currentConfig.Load(), sharedUpstreamClient.Load(), currentRateLimiter.Load()
+	t.Cleanup(func() {
+		currentConfig.Store(previousConfig)
+		sharedUpstreamClient.Store(previousClient)
+		currentRateLimiter.Store(previousLimiter)
+	})
+	// 配置文件格式错误时仍然完成其他检查
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"server": {`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configEnv, configPath)
+
+	var out bytes.Buffer
+	ok, err := runDoctor([]string{"--format", "json", "--port", "0"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report healthReport
+	if err := jsonStr.Unmarshal(out.Bytes(), &report); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out.String())
+	}
+	if ok != (report.Status != healthFail) {
+		t.Fatalf("ok = %v, status = %s", ok, report.Status)
+	}
+	if ok || checkStatuses(report.Checks)["config"] != healthFail {
+		t.Fatalf("ok = %v, config check = %s, want fail", ok, checkStatuses(report.Checks)["config"])
+	}
+	for _, name := range []string{"config", "token_file", "token_json", "token_expiry", "token_refresh", "port", "server", "client_env", "claude_config", "proxy"} {
+		if _, found := checkStatuses(report.Checks)[name]; !found {
+			t.Errorf("missing check %s", name)
+		}
+	}
+}
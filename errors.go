@@ -0,0 +1,147 @@
+package main
+
+import (
+	jsonStr "encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// anthropicError 表示返回给客户端的 Anthropic 格式错误，
+// SDK 根据状态码和 error.type 抛出对应的异常并决定是否重试
+type anthropicError struct {
+	Status  int
+	Type    string
+	Message string
+}
+
+func (e *anthropicError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Type, e.Message)
+}
+
+// newAnthropicError 创建错误，error.type 由状态码决定
+func newAnthropicError(status int, format string, args ...any) *anthropicError {
+	return &anthropicError{
+		Status:  status,
+		Type:    errorTypeForStatus(status),
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// errorTypeForStatus 返回状态码对应的 Anthropic error.type
+func errorTypeForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusMethodNotAllowed:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusRequestEntityTooLarge:
+		return "request_too_large"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	case statusOverloaded:
+		return "overloaded_error"
+	default:
+		return "api_error"
+	}
+}
+
+// statusOverloaded Anthropic 表示服务过载的状态码
+const statusOverloaded = 529
+
+// body 返回错误响应体
+func (e *anthropicError) body() map[string]any {
+	return map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    e.Type,
+			"message": e.Message,
+		},
+	}
+}
+
+// writeAnthropicError 以 Anthropic 格式返回错误响应
+func writeAnthropicError(w http.ResponseWriter, apiErr *anthropicError) {
+	fmt.Printf("错误: %v\n", apiErr)
+	recordError(w, apiErr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	jsonStr.NewEncoder(w).Encode(apiErr.body())
+}
+
+// toAnthropicError 将处理请求过程中的错误映射为 Anthropic 格式错误
+func toAnthropicError(err error) *anthropicError {
+	var apiErr *anthropicError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		return upstreamToAnthropicError(upstreamErr)
+	}
+
+	var toolErr *toolInputError
+	if errors.As(err, &toolErr) {
+		return newAnthropicError(http.StatusInternalServerError, "%s", toolErr.Error())
+	}
+
+	return newAnthropicError(http.StatusInternalServerError, "%s", err.Error())
+}
+
+// upstreamToAnthropicError 将 CodeWhisperer 的非 200 响应映射为对应状态码的错误
+func upstreamToAnthropicError(e *upstreamError) *anthropicError {
+	message := fmt.Sprintf("CodeWhisperer returned status %d: %s", e.StatusCode, strings.TrimSpace(e.Body))
+
+	switch {
+	case e.StatusCode == http.StatusBadRequest && isContentLengthError(e.Body):
+		return newAnthropicError(http.StatusRequestEntityTooLarge, "%s", message)
+	case e.StatusCode == http.StatusBadRequest:
+		return newAnthropicError(http.StatusBadRequest, "%s", message)
+	case e.StatusCode == http.StatusUnauthorized,
+		e.StatusCode == http.StatusForbidden,
+		e.StatusCode == http.StatusNotFound,
+		e.StatusCode == http.StatusRequestEntityTooLarge,
+		e.StatusCode == http.StatusTooManyRequests:
+		return newAnthropicError(e.StatusCode, "%s", message)
+	case e.StatusCode == http.StatusBadGateway,
+		e.StatusCode == http.StatusServiceUnavailable,
+		e.StatusCode == http.StatusGatewayTimeout:
+		return newAnthropicError(statusOverloaded, "%s", message)
+	default:
+		return newAnthropicError(http.StatusInternalServerError, "%s", message)
+	}
+}
+
+// isContentLengthError 判断上游错误是否由输入过长引起
+func isContentLengthError(body string) bool {
+	return strings.Contains(body, "CONTENT_LENGTH_EXCEEDS_THRESHOLD") ||
+		strings.Contains(body, "Input is too long") ||
+		strings.Contains(body, "ContentLengthExceeded")
+}
+
+// exceptionToAnthropicError 将上游在事件流中返回的异常映射为错误，
+// 输入过长的异常已按 max_tokens 处理，不视为错误
+func exceptionToAnthropicError(exception string) *anthropicError {
+	switch {
+	case exception == "", strings.Contains(exception, "ContentLengthExceeded"):
+		return nil
+	case strings.Contains(exception, "Improperly formed request"),
+		strings.Contains(exception, "ValidationException"):
+		return newAnthropicError(http.StatusBadRequest, "%s", exception)
+	case strings.Contains(exception, "ThrottlingException"):
+		return newAnthropicError(http.StatusTooManyRequests, "%s", exception)
+	case strings.Contains(exception, "AccessDeniedException"):
+		return newAnthropicError(http.StatusForbidden, "%s", exception)
+	case strings.Contains(exception, "ServiceUnavailableException"):
+		return newAnthropicError(statusOverloaded, "%s", exception)
+	default:
+		return newAnthropicError(http.StatusInternalServerError, "%s", exception)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	jsonStr "encoding/json"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// checkErrorResponse 校验响应为指定状态码和类型的 Anthropic 格式错误
+func checkErrorResponse(t *testing.T, rec *httptest.ResponseRecorder, status int, errType string) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d, body: %s", rec.Code, status, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", ct)
+	}
+
+	var body struct {
+		Type  string `json:"type"`
+		Error struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := jsonStr.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("invalid error body %q: %v", rec.Body.String(), err)
+	}
+	if body.Type != "error" || body.Error.Type != errType || body.Error.Message == "" {
+		t.Fatalf("error body = %+v, want type %s", body, errType)
+	}
+}
+
+func TestUpstreamErrorMapping(t *testing.T) {
+	tests := []struct {
+		status     int
+		body       string
+		wantStatus int
+		wantType   string
+	}{
+		{400, `{"message":"Improperly formed request."}`, 400, "invalid_request_error"},
+		{400, `{"message":"Input is too long for requested model."}`, 413, "request_too_large"},
+		{401, `{}`, 401, "authentication_error"},
+		{429, `{"message":"Too many requests"}`, 429, "rate_limit_error"},
+		{500, `{}`, 500, "api_error"},
+		{503, `{}`, 529, "overloaded_error"},
+	}
+
+	// 关闭重试，直接检查上游错误的映射
+	setRetryConfig(t, RetryConfig{})
+
+	for _, mode := range []bool{false, true} {
+		for _, tt := range tests {
+			setupFakeUpstream(t)
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer upstream.Close()
+			codeWhispererURL = upstream.URL
+
+			rec := httptest.NewRecorder()
+			handleMessages(rec, messagesRequest(mode))
+			checkErrorResponse(t, rec, tt.wantStatus, tt.wantType)
+		}
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	setupFakeUpstream(t)
+
+	rec := httptest.NewRecorder()
+	handleMessages(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader("{")))
+	checkErrorResponse(t, rec, http.StatusBadRequest, "invalid_request_error")
+
+	rec = httptest.NewRecorder()
+	handleMessages(rec, httptest.NewRequest(http.MethodGet, "/v1/messages", nil))
+	checkErrorResponse(t, rec, http.StatusMethodNotAllowed, "invalid_request_error")
+
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("USERPROFILE", t.TempDir())
+	rec = httptest.NewRecorder()
+	handleMessages(rec, messagesRequest(false))
+	checkErrorResponse(t, rec, http.StatusUnauthorized, "authentication_error")
+}
+
+func TestExceptionToAnthropicError(t *testing.T) {
+	if apiErr := exceptionToAnthropicError("ContentLengthExceededException: too long"); apiErr != nil {
+		t.Fatalf("ContentLengthExceeded mapped to %v, want nil", apiErr)
+	}
+	if apiErr := exceptionToAnthropicError("ThrottlingException: slow down"); apiErr.Status != http.StatusTooManyRequests {
+		t.Fatalf("ThrottlingException mapped to %v", apiErr)
+	}
+}
+
+// eventStreamFrame 构造一个 AWS event stream 帧
+func eventStreamFrame(headers map[string]string, payload string) []byte {
+	var h bytes.Buffer
+	for name, value := range headers {
+		h.WriteByte(byte(len(name)))
+		h.WriteString(name)
+		h.WriteByte(7)
+		binary.Write(&h, binary.BigEndian, uint16(len(value)))
+		h.WriteString(value)
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(12+h.Len()+len(payload)+4))
+	binary.Write(&b, binary.BigEndian, uint32(h.Len()))
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(b.Bytes()))
+	b.Write(h.Bytes())
+	b.WriteString(payload)
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(b.Bytes()))
+	return b.Bytes()
+}
+
+// throttledUpstream 使用先返回部分文本、再返回 ThrottlingException 的上游
+func throttledUpstream(t *testing.T) {
+	t.Helper()
+
+	setupFakeUpstream(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(eventStreamFrame(map[string]string{":message-type": "event", ":event-type": "assistantResponseEvent"}, `{"content":"partial"}`))
+		w.Write(eventStreamFrame(map[string]string{":message-type": "exception", ":exception-type": "ThrottlingException"}, `{"message":"slow down"}`))
+	}))
+	t.Cleanup(upstream.Close)
+	codeWhispererURL = upstream.URL
+}
+
+func TestNonStreamExceptionReturnsError(t *testing.T) {
+	throttledUpstream(t)
+
+	// 已收到部分内容时也不能以 200 和 end_turn 返回
+	rec := httptest.NewRecorder()
+	handleMessages(rec, messagesRequest(false))
+	checkErrorResponse(t, rec, http.StatusTooManyRequests, "rate_limit_error")
+}
+
+func TestStreamExceptionSendsErrorEvent(t *testing.T) {
+	throttledUpstream(t)
+
+	rec := httptest.NewRecorder()
+	handleMessages(rec, messagesRequest(true))
+	body := rec.Body.String()
+	if !strings.Contains(body, "event: error") || !strings.Contains(body, `"rate_limit_error"`) {
+		t.Fatalf("stream body = %s, want rate_limit_error event", body)
+	}
+	if strings.Contains(body, "message_stop") || strings.Contains(body, "end_turn") {
+		t.Fatalf("stream ended normally after an exception: %s", body)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 健康检查结果
+const (
+	healthPass = "pass"
+	healthWarn = "warn"
+	healthFail = "fail"
+)
+
+// tokenExpiryWarning token 剩余有效期少于该时间时给出警告
+const tokenExpiryWarning = 5 * time.Minute
+
+// healthCheck 一项检查的结果
+type healthCheck struct {
+	Name    string         `json:"name"`
+	Status  string         `json:"status"`
+	Message string         `json:"message"`
+	Fix     string         `json:"fix,omitempty"` // 检查未通过时的修复建议
+	Detail  map[string]any `json:"detail,omitempty"`
+}
+
+// healthReport 健康检查报告，有一项失败时整体失败
+type healthReport struct {
+	Status string        `json:"status"`
+	Time   time.Time     `json:"time"`
+	Checks []healthCheck `json:"checks"`
+}
+
+// newHealthReport 汇总各项检查结果
+func newHealthReport(checks ...healthCheck) healthReport {
+	report := healthReport{Status: healthPass, Time: time.Now(), Checks: checks}
+	for _, check := range checks {
+		switch {
+		case check.Status == healthFail:
+			report.Status = healthFail
+		case check.Status == healthWarn && report.Status == healthPass:
+			report.Status = healthWarn
+		}
+	}
+	return report
+}
+
+// readinessReport 检查代理服务器能否处理请求，probe 为 true 时实际连接上游服务
+func readinessReport(ctx context.Context, probe bool) healthReport {
+	statuses := accounts.snapshot()
+	checks := []healthCheck{checkAccounts(statuses), checkToken(statuses, time.Now()), checkUpstream(statuses)}
+	if probe {
+		checks = append(checks, probeUpstream(ctx, time.Duration(config().Health.ProbeTimeout)))
+	}
+	return newHealthReport(checks...)
+}
+
+// firstEnabled 返回第一个未停用的账号
+func firstEnabled(statuses []accountStatus) (accountStatus, bool) {
+	for _, status := range statuses {
+		if !status.Disabled {
+			return status, true
+		}
+	}
+	return accountStatus{}, false
+}
+
+// checkAccounts 检查是否有可用的账号
+func checkAccounts(statuses []accountStatus) healthCheck {
+	check := healthCheck{Name: "accounts", Detail: map[string]any{"total": len(statuses)}}
+	enabled := 0
+	for _, status := range statuses {
+		if !status.Disabled {
+			enabled++
+		}
+	}
+	check.Detail["enabled"] = enabled
+	if enabled == 0 {
+		check.Status, check.Message = healthFail, "all accounts are disabled"
+		check.Fix = "POST /admin/accounts/{name}/enable"
+		return check
+	}
+	check.Status, check.Message = healthPass, fmt.Sprintf("%d of %d accounts enabled", enabled, len(statuses))
+	return check
+}
+
+// checkToken 检查 token 文件是否存在以及 token 是否过期
+func checkToken(statuses []accountStatus, now time.Time) healthCheck {
+	check := healthCheck{Name: "token"}
+	status, ok := firstEnabled(statuses)
+	if !ok {
+		check.Status, check.Message = healthFail, "no enabled account"
+		return check
+	}
+	check.Detail = map[string]any{"account": status.Name, "path": status.TokenPath}
+	if status.TokenError != "" {
+		check.Status, check.Message = healthFail, status.TokenError
+		return check
+	}
+	if status.TokenExpiresAt == nil {
+		check.Status, check.Message = healthPass, "token present, expiry unknown"
+		return check
+	}
+
+	left := status.TokenExpiresAt.Sub(now)
+	check.Detail["expires_at"] = status.TokenExpiresAt
+	check.Detail["expires_in_seconds"] = int64(left.Seconds())
+	switch {
+	case left <= 0:
+		check.Status, check.Message = healthFail, fmt.Sprintf("token expired at %s", status.TokenExpiresAt.Format(time.RFC3339))
+		check.Fix = "run kiro2cc refresh or POST /admin/token/refresh"
+	case left < tokenExpiryWarning:
+		check.Status, check.Message = healthWarn, fmt.Sprintf("token expires in %v", left.Round(time.Second))
+	default:
+		check.Status, check.Message = healthPass, fmt.Sprintf("token valid for %v", left.Round(time.Second))
+	}
+	return check
+}
+
+// checkUpstream 报告最近一次上游请求的结果，最近一次失败时给出警告
+func checkUpstream(statuses []accountStatus) healthCheck {
+	check := healthCheck{Name: "upstream", Detail: map[string]any{}}
+	status, ok := firstEnabled(statuses)
+	if !ok {
+		check.Status, check.Message = healthFail, "no enabled account"
+		return check
+	}
+	if status.LastSuccess != nil {
+		check.Detail["last_success"] = status.LastSuccess
+	}
+	if status.LastFailure != nil {
+		check.Detail["last_failure"] = status.LastFailure
+		check.Detail["last_error"] = status.LastError
+	}
+
+	switch {
+	case status.LastFailure != nil && (status.LastSuccess == nil || status.LastFailure.After(*status.LastSuccess)):
+		check.Status, check.Message = healthWarn, "last upstream request failed: "+status.LastError
+	case status.LastSuccess == nil:
+		check.Status, check.Message = healthPass, "no upstream requests yet"
+	default:
+		check.Status, check.Message = healthPass, "last upstream request succeeded"
+	}
+	return check
+}
+
+// probeUpstream 并发连接 CodeWhisperer 和 token 刷新服务，收到任意 HTTP 响应即视为可达
+func probeUpstream(ctx context.Context, timeout time.Duration) healthCheck {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	targets := map[string]string{"codewhisperer": codeWhispererURL, "token_refresh": refreshTokenURL}
+	results := map[string]any{}
+	var failed []string
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, url := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			result := map[string]any{"url": url}
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+			if err == nil {
+				var resp *http.Response
+				if resp, err = upstreamClient().Do(req); err == nil {
+					resp.Body.Close()
+					result["status_code"] = resp.StatusCode
+				}
+			}
+			result["latency_ms"] = time.Since(start).Milliseconds()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				result["error"] = err.Error()
+				failed = append(failed, name)
+			}
+			results[name] = result
+		}()
+	}
+	wg.Wait()
+
+	check := healthCheck{Name: "probe", Detail: results}
+	if len(failed) > 0 {
+		check.Status, check.Message = healthFail, fmt.Sprintf("unreachable: %v", failed)
+		return check
+	}
+	check.Status, check.Message = healthPass, "upstream reachable"
+	return check
+}
+
+// handleLiveness 进程存活即返回成功
+func handleLiveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newHealthReport(healthCheck{
+		Name:    "process",
+		Status:  healthPass,
+		Message: "running for " + time.Since(serverStartedAt).Round(time.Second).String(),
+	}))
+}
+
+// handleReadiness 检查能否处理请求，有一项失败时返回 503。
+// 配置了 health.probe 时实际连接上游服务。该接口不需要认证，
+// 只有带上管理 token 的请求才能用 probe 参数覆盖配置，避免任何人都能触发对外连接
+func handleReadiness(w http.ResponseWriter, r *http.Request) {
+	probe := config().Health.Probe
+	if value := r.URL.Query().Get("probe"); value != "" && hasAdminToken(r) {
+		probe, _ = strconv.ParseBool(value)
+	}
+
+	report := readinessReport(r.Context(), probe)
+	status := http.StatusOK
+	if report.Status == healthFail {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, report)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	jsonStr "encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// readiness 请求就绪检查并返回状态码和各项检查结果，token 不为空时带上管理 token
+func readiness(t *testing.T, target, token string) (int, healthReport, map[string]healthCheck) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	handleReadiness(rec, req)
+	var report healthReport
+	if err := jsonStr.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	checks := map[string]healthCheck{}
+	for _, check := range report.Checks {
+		checks[check.Name] = check
+	}
+	return rec.Code, report, checks
+}
+
+// writeTestToken 写入指定过期时间的 token 文件
+func writeTestToken(t *testing.T, expiresAt time.Time) {
+	t.Helper()
+	token := `{"accessToken":"test-token","refreshToken":"refresh","expiresAt":"` + expiresAt.UTC().Format(time.RFC3339) + `"}`
+	if err := os.WriteFile(getTokenFilePath(), []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	setupFakeUpstream(t)
+	adminServer(t, defaultConfig())
+
+	writeTestToken(t, time.Now().Add(time.Hour))
+	code, report, checks := readiness(t, "/health/ready", "")
+	if code != http.StatusOK || report.Status != healthPass || checks["token"].Status != healthPass {
+		t.Fatalf("valid token: %d %+v", code, report)
+	}
+	if _, ok := checks["probe"]; ok {
+		t.Fatal("probe ran without being requested")
+	}
+
+	writeTestToken(t, time.Now().Add(time.Minute))
+	code, report, _ = readiness(t, "/health/ready", "")
+	if code != http.StatusOK || report.Status != healthWarn {
+		t.Fatalf("token about to expire: %d %+v", code, report)
+	}
+
+	writeTestToken(t, time.Now().Add(-time.Minute))
+	code, _, checks = readiness(t, "/health/ready", "")
+	if code != http.StatusServiceUnavailable || checks["token"].Status != healthFail {
+		t.Fatalf("expired token: %d %+v", code, checks["token"])
+	}
+
+	os.Remove(getTokenFilePath())
+	code, _, checks = readiness(t, "/health/ready", "")
+	if code != http.StatusServiceUnavailable || checks["token"].Status != healthFail {
+		t.Fatalf("missing token: %d %+v", code, checks["token"])
+	}
+
+	// 最近一次上游请求失败时给出警告
+	writeTestToken(t, time.Now().Add(time.Hour))
+	accounts.recordUpstream(defaultAccount, &upstreamConnError{Err: os.ErrDeadlineExceeded})
+	_, _, checks = readiness(t, "/health/ready", "")
+	if checks["upstream"].Status != healthWarn || checks["upstream"].Detail["last_error"] == nil {
+		t.Fatalf("upstream check after failure = %+v", checks["upstream"])
+	}
+}
+
+func TestReadinessProbe(t *testing.T) {
+	setupFakeUpstream(t)
+	adminServer(t, defaultConfig())
+	writeTestToken(t, time.Now().Add(time.Hour))
+
+	refresh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer refresh.Close()
+	originalURL := refreshTokenURL
+	refreshTokenURL = refresh.URL
+	defer func() { refreshTokenURL = originalURL }()
+
+	// 不带管理 token 时忽略 probe 参数
+	if _, _, checks := readiness(t, "/health/ready?probe=1", ""); checks["probe"].Name != "" {
+		t.Fatalf("probe ran without admin token: %+v", checks["probe"])
+	}
+
+	code, _, checks := readiness(t, "/health/ready?probe=1", testAdminToken)
+	if code != http.StatusOK || checks["probe"].Status != healthPass {
+		t.Fatalf("probe with reachable upstream: %d %+v", code, checks["probe"])
+	}
+
+	refresh.Close()
+	code, _, checks = readiness(t, "/health/ready?probe=1", testAdminToken)
+	if code != http.StatusServiceUnavailable || checks["probe"].Status != healthFail {
+		t.Fatalf("probe with unreachable refresh endpoint: %d %+v", code, checks["probe"])
+	}
+}
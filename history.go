@@ -0,0 +1,213 @@
+package main
+
+import (
+	jsonStr "encoding/json"
+	"fmt"
+	"log"
+)
+
+// placeholderUserContent 规范化消息时插入的中性占位内容
+const placeholderUserContent = "Continue."
+
+// normalizeMessages 保证消息严格按 user、assistant 交替排列，并以 user 消息开始和结束，
+// CodeWhisperer 会拒绝不交替的历史记录。连续的同角色消息会被合并，
+// 以 assistant 开头时在前面插入占位的 user 消息，以 assistant 结尾时在后面插入占位的 user 消息
+func normalizeMessages(messages []AnthropicRequestMessage) []AnthropicRequestMessage {
+	var normalized []AnthropicRequestMessage
+
+	for _, msg := range messages {
+		role := msg.Role
+		if role != "assistant" {
+			role = "user"
+		}
+
+		if len(normalized) == 0 && role == "assistant" {
+			normalized = append(normalized, AnthropicRequestMessage{Role: "user", Content: placeholderUserContent})
+		}
+
+		if last := len(normalized) - 1; last >= 0 && normalized[last].Role == role {
+			normalized[last].Content = mergeContent(normalized[last].Content, msg.Content)
+			continue
+		}
+
+		normalized = append(normalized, AnthropicRequestMessage{Role: role, Content: msg.Content})
+	}
+
+	if len(normalized) > 0 && normalized[len(normalized)-1].Role == "assistant" {
+		normalized = append(normalized, AnthropicRequestMessage{Role: "user", Content: placeholderUserContent})
+	}
+
+	return normalized
+}
+
+// mergeContent 合并两条同角色消息的内容，结果统一为内容块数组
+func mergeContent(a, b any) any {
+	return append(contentBlocks(a), contentBlocks(b)...)
+}
+
+// contentBlocks 将消息内容转换为内容块数组
+func contentBlocks(content any) []any {
+	switch v := content.(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []any{map[string]any{"type": "text", "text": v}}
+	case []any:
+		return append([]any{}, v...)
+	case nil:
+		return nil
+	default:
+		return []any{v}
+	}
+}
+
+// ModelContextBudget 各模型发送给上游的估算输入 token 上限，超出后从最早的对话轮次开始截断。
+// 取值低于模型的上下文窗口，为输出和估算误差留出余量
+var ModelContextBudget = map[string]int{
+	"claude-sonnet-4-20250514":  150000,
+	"claude-3-5-haiku-20241022": 150000,
+}
+
+// defaultContextBudget 未配置的模型使用的输入 token 上限
+const defaultContextBudget = 100000
+
+// truncatedTurnsHeader 响应头，告知客户端本次请求截断了多少轮历史对话
+const truncatedTurnsHeader = "x-kiro2cc-truncated-turns"
+
+// contextOverBudgetHeader 响应头，告知客户端截断后的请求仍超出模型的上下文上限
+const contextOverBudgetHeader = "x-kiro2cc-context-over-budget"
+
+// modelContextBudget 返回模型的输入 token 上限
+func modelContextBudget(model string) int {
+	if budget, ok := ModelContextBudget[model]; ok {
+		return budget
+	}
+	return defaultContextBudget
+}
+
+// truncateHistory 在估算输入超出模型上限时，从最早的轮次开始丢弃历史对话。
+// 输入按实际发送给上游的 CodeWhisperer 请求估算。
+// system 消息和当前消息始终保留，丢弃的轮次以 user、assistant 为一对，
+// 保留下来的第一条 user 消息不能是孤立的 tool_result，以保证 tool_use 与 tool_result 成对出现。
+// 返回截断后的请求、丢弃的轮次数，以及截断后是否仍超出上限
+func truncateHistory(anthropicReq AnthropicRequest) (AnthropicRequest, int, bool) {
+	messages, _ := splitPrefill(anthropicReq.Messages)
+	var prefillMsg []AnthropicRequestMessage
+	if len(messages) < len(anthropicReq.Messages) {
+		prefillMsg = anthropicReq.Messages[len(messages):]
+	}
+	messages = normalizeMessages(messages)
+	if len(messages) == 0 {
+		return anthropicReq, 0, false
+	}
+
+	budget := modelContextBudget(anthropicReq.Model)
+	cwReq := buildCodeWhispererRequest(anthropicReq)
+	total := estimateUpstreamTokens(cwReq)
+	if total <= budget {
+		return anthropicReq, 0, false
+	}
+
+	// 历史记录中 system 消息在前，每条占一对，之后每轮对话占一对
+	history := cwReq.ConversationState.History
+	offset := 2 * len(anthropicReq.System)
+
+	// 当前消息包含 tool_result 时，必须保留与之对应的最后一轮
+	keepTurns := 0
+	if hasToolResult(messages[len(messages)-1].Content) {
+		keepTurns = 1
+	}
+
+	dropped := 0
+	turns := (len(messages) - 1) / 2
+	for dropped < turns-keepTurns {
+		if total <= budget && !hasToolResult(messages[2*dropped].Content) {
+			break
+		}
+		total -= historyEntryTokens(history[offset+2*dropped]) + historyEntryTokens(history[offset+2*dropped+1])
+		dropped++
+	}
+	overBudget := total > budget
+	if overBudget {
+		log.Printf("请求估算 %d token，丢弃 %d 轮历史对话后仍超出 %s 的上下文上限 %d", total, dropped, anthropicReq.Model, budget)
+	}
+	if dropped == 0 {
+		return anthropicReq, 0, overBudget
+	}
+
+	kept := append([]AnthropicRequestMessage{}, messages[2*dropped:]...)
+	notice := fmt.Sprintf("[%d earlier conversation turns were omitted to fit the context window.]", dropped)
+	kept[0].Content = mergeContent(notice, kept[0].Content)
+
+	log.Printf("历史对话超出 %s 的上下文上限 %d，已截断 %d 轮", anthropicReq.Model, budget, dropped)
+
+	anthropicReq.Messages = append(kept, prefillMsg...)
+	return anthropicReq, dropped, overBudget
+}
+
+// estimateUpstreamTokens 按 CodeWhisperer 请求中实际发送的文本估算输入 token 数
+func estimateUpstreamTokens(cwReq CodeWhispererRequest) int {
+	current := cwReq.ConversationState.CurrentMessage.UserInputMessage
+	total := estimateTokens(current.Content)
+	if tools := current.UserInputMessageContext.Tools; len(tools) > 0 {
+		total += estimateContentTokens(tools)
+	}
+	for _, entry := range cwReq.ConversationState.History {
+		total += historyEntryTokens(entry)
+	}
+	return total
+}
+
+// historyEntryTokens 估算一条 CodeWhisperer 历史记录的 token 数
+func historyEntryTokens(entry any) int {
+	switch v := entry.(type) {
+	case HistoryUserMessage:
+		return estimateTokens(v.UserInputMessage.Content)
+	case HistoryAssistantMessage:
+		return estimateTokens(v.AssistantResponseMessage.Content) + estimateContentTokens(v.AssistantResponseMessage.ToolUses)
+	default:
+		return estimateContentTokens(v)
+	}
+}
+
+// estimateRequestTokens 估算发送给上游的输入 token 数
+func estimateRequestTokens(system []AnthropicSystemMessage, tools []AnthropicTool, messages []AnthropicRequestMessage) int {
+	total := 0
+	for _, sysMsg := range system {
+		total += estimateTokens(sysMsg.Text)
+	}
+	if len(tools) > 0 {
+		total += estimateContentTokens(tools)
+	}
+	for _, msg := range messages {
+		total += estimateContentTokens(msg.Content)
+	}
+	return total
+}
+
+// estimateContentTokens 按 JSON 序列化后的长度估算内容的 token 数
+func estimateContentTokens(content any) int {
+	if s, ok := content.(string); ok {
+		return estimateTokens(s)
+	}
+	data, err := jsonStr.Marshal(content)
+	if err != nil {
+		return 0
+	}
+	return estimateTokens(string(data))
+}
+
+// hasToolResult 检查消息内容中是否包含 tool_result 块
+func hasToolResult(content any) bool {
+	blocks, ok := content.([]any)
+	if !ok {
+		return false
+	}
+	for _, block := range blocks {
+		if m, ok := block.(map[string]any); ok && m["type"] == "tool_result" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeMessages(t *testing.T) {
+	toolUse := map[string]any{"type": "tool_use", "id": "toolu_1", "name": "Read", "input": map[string]any{"file_path": "a.go"}}
+	toolResult := map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": "package main"}
+	reminder := map[string]any{"type": "text", "text": "<system-reminder>todo list is empty</system-reminder>"}
+
+	tests := []struct {
+		name      string
+		messages  []AnthropicRequestMessage
+		wantRoles []string
+		wantTexts []string
+	}{
+		{
+			name:      "empty",
+			messages:  nil,
+			wantRoles: nil,
+			wantTexts: nil,
+		},
+		{
+			name: "single prompt",
+			messages: []AnthropicRequestMessage{
+				{Role: "user", Content: "hi"},
+			},
+			wantRoles: []string{"user"},
+			wantTexts: []string{"hi"},
+		},
+		{
+			name: "claude code tool loop",
+			messages: []AnthropicRequestMessage{
+				{Role: "user", Content: []any{reminder, map[string]any{"type": "text", "text": "read a.go"}}},
+				{Role: "assistant", Content: []any{map[string]any{"type": "text", "text": "Reading."}, toolUse}},
+				{Role: "user", Content: []any{toolResult}},
+			},
+			wantRoles: []string{"user", "assistant", "user"},
+			wantTexts: []string{
+				"<system-reminder>todo list is empty</system-reminder>\nread a.go",
+				"Reading.",
+				"package main",
+			},
+		},
+		{
+			name: "consecutive user messages are merged",
+			messages: []AnthropicRequestMessage{
+				{Role: "user", Content: []any{toolResult}},
+				{Role: "user", Content: "now fix it"},
+			},
+			wantRoles: []string{"user"},
+			wantTexts: []string{"package main\nnow fix it"},
+		},
+		{
+			name: "consecutive assistant messages are merged",
+			messages: []AnthropicRequestMessage{
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: "first"},
+				{Role: "assistant", Content: "second"},
+				{Role: "user", Content: "ok"},
+			},
+			wantRoles: []string{"user", "assistant", "user"},
+			wantTexts: []string{"hi", "first\nsecond", "ok"},
+		},
+		{
+			name: "leading assistant gets placeholder user",
+			messages: []AnthropicRequestMessage{
+				{Role: "assistant", Content: "How can I help?"},
+				{Role: "user", Content: "explain"},
+			},
+			wantRoles: []string{"user", "assistant", "user"},
+			wantTexts: []string{placeholderUserContent, "How can I help?", "explain"},
+		},
+		{
+			name: "trailing assistant gets placeholder user",
+			messages: []AnthropicRequestMessage{
+				{Role: "user", Content: "hi"},
+				{Role: "assistant", Content: "hello"},
+			},
+			wantRoles: []string{"user", "assistant", "user"},
+			wantTexts: []string{"hi", "hello", placeholderUserContent},
+		},
+		{
+			name: "unknown role treated as user",
+			messages: []AnthropicRequestMessage{
+				{Role: "system", Content: "be brief"},
+				{Role: "user", Content: "hi"},
+			},
+			wantRoles: []string{"user"},
+			wantTexts: []string{"be brief\nhi"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := normalizeMessages(tt.messages)
+			if len(got) != len(tt.wantRoles) {
+				t.Fatalf("got %d messages, want %d: %v", len(got), len(tt.wantRoles), got)
+			}
+			for i, msg := range got {
+				if msg.Role != tt.wantRoles[i] {
+					t.Errorf("message %d role = %q, want %q", i, msg.Role, tt.wantRoles[i])
+				}
+				if text := getMessageContent(msg.Content); text != tt.wantTexts[i] {
+					t.Errorf("message %d content = %q, want %q", i, text, tt.wantTexts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBuildCodeWhispererRequestHistoryAlternates(t *testing.T) {
+	req := AnthropicRequest{
+		Model:  "claude-sonnet-4-20250514",
+		System: []AnthropicSystemMessage{{Type: "text", Text: "You are Claude Code."}},
+		Messages: []AnthropicRequestMessage{
+			{Role: "assistant", Content: "Ready."},
+			{Role: "user", Content: "a"},
+			{Role: "user", Content: "b"},
+			{Role: "assistant", Content: "c"},
+			{Role: "assistant", Content: "d"},
+			{Role: "user", Content: "current"},
+		},
+	}
+
+	cwReq := buildCodeWhispererRequest(req)
+	if got := cwReq.ConversationState.CurrentMessage.UserInputMessage.Content; got != "current" {
+		t.Fatalf("current message = %q, want %q", got, "current")
+	}
+
+	history := cwReq.ConversationState.History
+	// system 一对 + 占位 user/Ready. 一对 + a,b/c,d 一对
+	if len(history) != 6 {
+		t.Fatalf("got %d history entries, want 6", len(history))
+	}
+	for i, entry := range history {
+		_, isUser := entry.(HistoryUserMessage)
+		if isUser != (i%2 == 0) {
+			t.Fatalf("history entry %d has wrong role: %#v", i, entry)
+		}
+	}
+}
+
+func TestTruncateHistory(t *testing.T) {
+	long := strings.Repeat("x", 4000) // 约 1000 token
+	toolUse := map[string]any{"type": "tool_use", "id": "toolu_1", "name": "Bash", "input": map[string]any{}}
+	toolResult := map[string]any{"type": "tool_result", "tool_use_id": "toolu_1", "content": long}
+
+	ModelContextBudget["test-model"] = 1500
+	defer delete(ModelContextBudget, "test-model")
+
+	t.Run("within budget", func(t *testing.T) {
+		req := AnthropicRequest{Model: "test-model", Messages: []AnthropicRequestMessage{
+			{Role: "user", Content: "hi"},
+		}}
+		if _, dropped, overBudget := truncateHistory(req); dropped != 0 || overBudget {
+			t.Fatalf("dropped = %d, over budget = %v, want 0 and false", dropped, overBudget)
+		}
+	})
+
+	t.Run("estimates what is sent upstream", func(t *testing.T) {
+		// 思考块不会发送给上游，不计入输入
+		thinking := map[string]any{"type": "thinking", "thinking": long + long, "signature": "sig"}
+		req := AnthropicRequest{Model: "test-model", Messages: []AnthropicRequestMessage{
+			{Role: "user", Content: "question"},
+			{Role: "assistant", Content: []any{thinking, map[string]any{"type": "text", "text": "answer"}}},
+			{Role: "user", Content: "current"},
+		}}
+		if _, dropped, overBudget := truncateHistory(req); dropped != 0 || overBudget {
+			t.Fatalf("dropped = %d, over budget = %v, want 0 and false", dropped, overBudget)
+		}
+	})
+
+	t.Run("drops oldest turns", func(t *testing.T) {
+		req := AnthropicRequest{Model: "test-model", Messages: []AnthropicRequestMessage{
+			{Role: "user", Content: long},
+			{Role: "assistant", Content: "a1"},
+			{Role: "user", Content: long},
+			{Role: "assistant", Content: "a2"},
+			{Role: "user", Content: "current"},
+		}}
+		got, dropped, _ := truncateHistory(req)
+		if dropped != 1 || len(got.Messages) != 3 {
+			t.Fatalf("dropped = %d, messages = %d, want 1 and 3", dropped, len(got.Messages))
+		}
+		if text := getMessageContent(got.Messages[0].Content); !strings.Contains(text, "1 earlier conversation turns were omitted") {
+			t.Fatalf("missing truncation notice: %q", text)
+		}
+	})
+
+	t.Run("keeps tool_use and tool_result together", func(t *testing.T) {
+		req := AnthropicRequest{Model: "test-model", Messages: []AnthropicRequestMessage{
+			{Role: "user", Content: long},
+			{Role: "assistant", Content: []any{toolUse}},
+			{Role: "user", Content: []any{toolResult}},
+			{Role: "assistant", Content: "done"},
+			{Role: "user", Content: "current"},
+		}}
+		got, dropped, _ := truncateHistory(req)
+		// 丢弃第一轮后，第二轮以孤立的 tool_result 开头，也必须丢弃
+		if dropped != 2 || len(got.Messages) != 1 {
+			t.Fatalf("dropped = %d, messages = %d, want 2 and 1", dropped, len(got.Messages))
+		}
+	})
+
+	t.Run("keeps the turn answered by the current tool_result", func(t *testing.T) {
+		req := AnthropicRequest{Model: "test-model", Messages: []AnthropicRequestMessage{
+			{Role: "user", Content: long},
+			{Role: "assistant", Content: []any{toolUse}},
+			{Role: "user", Content: []any{toolResult, map[string]any{"type": "text", "text": long}}},
+		}}
+		// 无法再截断时仍超出上限
+		if _, dropped, overBudget := truncateHistory(req); dropped != 0 || !overBudget {
+			t.Fatalf("dropped = %d, over budget = %v, want 0 and true", dropped, overBudget)
+		}
+	})
+}
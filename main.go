@@ -2,22 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	jsonStr "encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/bestk/kiro2cc/parser"
 )
 
+// refreshTokenURL Kiro 刷新 token 的接口地址
+var refreshTokenURL = "https://prod.us-east-1.auth.desktop.kiro.dev/refreshToken"
+
 // TokenData 表示token文件的结构
 type TokenData struct {
 	AccessToken  string `json:"accessToken"`
@@ -80,14 +86,17 @@ type HistoryAssistantMessage struct {
 
 // AnthropicRequest 表示 Anthropic API 的请求结构
 type AnthropicRequest struct {
-	Model       string                    `json:"model"`
-	MaxTokens   int                       `json:"max_tokens"`
-	Messages    []AnthropicRequestMessage `json:"messages"`
-	System      []AnthropicSystemMessage  `json:"system,omitempty"`
-	Tools       []AnthropicTool           `json:"tools,omitempty"`
-	Stream      bool                      `json:"stream"`
-	Temperature *float64                  `json:"temperature,omitempty"`
-	Metadata    map[string]any            `json:"metadata,omitempty"`
+	Model         string                    `json:"model"`
+	MaxTokens     int                       `json:"max_tokens"`
+	Messages      []AnthropicRequestMessage `json:"messages"`
+	System        []AnthropicSystemMessage  `json:"system,omitempty"`
+	Tools         []AnthropicTool           `json:"tools,omitempty"`
+	Stream        bool                      `json:"stream"`
+	StopSequences []string                  `json:"stop_sequences,omitempty"`
+	ToolChoice    *AnthropicToolChoice      `json:"tool_choice,omitempty"`
+	Thinking      *AnthropicThinking        `json:"thinking,omitempty"`
+	Temperature   *float64                  `json:"temperature,omitempty"`
+	Metadata      map[string]any            `json:"metadata,omitempty"`
 }
 
 // AnthropicStreamResponse 表示 Anthropic 流式响应的结构
@@ -152,6 +161,8 @@ func getMessageContent(content any) string {
 							texts = append(texts, *cb.Content)
 						case "text":
 							texts = append(texts, *cb.Text)
+						case "thinking", "redacted_thinking":
+							// 思考块无法回传给 CodeWhisperer，统一从历史中去除
 						}
 					}
 
@@ -236,27 +247,31 @@ func buildCodeWhispererRequest(anthropicReq AnthropicRequest) CodeWhispererReque
 	}
 	cwReq.ConversationState.ChatTriggerType = "MANUAL"
 	cwReq.ConversationState.ConversationId = generateUUID()
-	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = getMessageContent(anthropicReq.Messages[len(anthropicReq.Messages)-1].Content)
+	// 最后一条消息为 assistant 时作为预填充处理，当前消息为其之前的用户消息
+	messages, prefill := splitPrefill(anthropicReq.Messages)
+	messages = normalizeMessages(messages)
+	var currentContent any = ""
+	if len(messages) > 0 {
+		currentContent = messages[len(messages)-1].Content
+	}
+	cwReq.ConversationState.CurrentMessage.UserInputMessage.Content = getMessageContent(currentContent)
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.ModelId = ModelMap[anthropicReq.Model]
 	cwReq.ConversationState.CurrentMessage.UserInputMessage.Origin = "AI_EDITOR"
-	// 处理 tools 信息
-	if len(anthropicReq.Tools) > 0 {
-		var tools []CodeWhispererTool
-		for _, tool := range anthropicReq.Tools {
-			cwTool := CodeWhispererTool{}
-			cwTool.ToolSpecification.Name = tool.Name
-			cwTool.ToolSpecification.Description = tool.Description
-			cwTool.ToolSpecification.InputSchema = InputSchema{
-				Json: tool.InputSchema,
-			}
-			tools = append(tools, cwTool)
-		}
+	if instruction := toolChoiceInstruction(anthropicReq); instruction != "" {
+		cwReq.ConversationState.CurrentMessage.UserInputMessage.Content += "\n\n" + instruction
+	}
+	if prefill != "" {
+		cwReq.ConversationState.CurrentMessage.UserInputMessage.Content += "\n\n" + prefillInstruction(prefill)
+	}
+	// 处理 tools 信息，tool_choice 为 none 时不发送工具
+	if len(anthropicReq.Tools) > 0 && !toolsDisabled(anthropicReq) {
+		tools := sanitizeTools(anthropicReq.Tools)
 		cwReq.ConversationState.CurrentMessage.UserInputMessage.UserInputMessageContext.Tools = tools
 	}
 
 	// 构建历史消息
 	// 先处理 system 消息或者常规历史消息
-	if len(anthropicReq.System) > 0 || len(anthropicReq.Messages) > 1 {
+	if len(anthropicReq.System) > 0 || len(messages) > 1 {
 		var history []any
 
 		// 首先添加每个 system 消息作为独立的历史记录项
@@ -276,24 +291,18 @@ func buildCodeWhispererRequest(anthropicReq AnthropicRequest) CodeWhispererReque
 			}
 		}
 
-		// 然后处理常规消息历史
-		for i := 0; i < len(anthropicReq.Messages)-1; i++ {
-			if anthropicReq.Messages[i].Role == "user" {
-				userMsg := HistoryUserMessage{}
-				userMsg.UserInputMessage.Content = getMessageContent(anthropicReq.Messages[i].Content)
-				userMsg.UserInputMessage.ModelId = ModelMap[anthropicReq.Model]
-				userMsg.UserInputMessage.Origin = "AI_EDITOR"
-				history = append(history, userMsg)
-
-				// 检查下一条消息是否是助手回复
-				if i+1 < len(anthropicReq.Messages)-1 && anthropicReq.Messages[i+1].Role == "assistant" {
-					assistantMsg := HistoryAssistantMessage{}
-					assistantMsg.AssistantResponseMessage.Content = getMessageContent(anthropicReq.Messages[i+1].Content)
-					assistantMsg.AssistantResponseMessage.ToolUses = make([]any, 0)
-					history = append(history, assistantMsg)
-					i++ // 跳过已处理的助手消息
-				}
-			}
+		// 然后处理常规消息历史，规范化后的消息严格按 user、assistant 成对出现
+		for i := 0; i+1 < len(messages)-1; i += 2 {
+			userMsg := HistoryUserMessage{}
+			userMsg.UserInputMessage.Content = getMessageContent(messages[i].Content)
+			userMsg.UserInputMessage.ModelId = ModelMap[anthropicReq.Model]
+			userMsg.UserInputMessage.Origin = "AI_EDITOR"
+			history = append(history, userMsg)
+
+			assistantMsg := HistoryAssistantMessage{}
+			assistantMsg.AssistantResponseMessage.Content = getMessageContent(messages[i+1].Content)
+			assistantMsg.AssistantResponseMessage.ToolUses = make([]any, 0)
+			history = append(history, assistantMsg)
 		}
 
 		cwReq.ConversationState.History = history
@@ -310,12 +319,28 @@ func main() {
 		fmt.Println("  kiro2cc export  - 导出环境变量")
 		fmt.Println("  kiro2cc claude  - 跳过 claude 地区限制")
 		fmt.Println("  kiro2cc server [port] - 启动Anthropic API代理服务器")
+		fmt.Println("  kiro2cc run -- claude [参数...] - 启动临时代理服务器并运行 Claude Code")
+		fmt.Println("  kiro2cc doctor [--port 8080] [--format text|json] - 诊断常见问题")
+		fmt.Println("  kiro2cc usage [--from YYYY-MM-DD] [--to YYYY-MM-DD] [--by day,key,model] [--format table|csv|json] - 查看用量")
 		fmt.Println("  author https://github.com/bestK/kiro2cc")
 		os.Exit(1)
 	}
 
 	command := os.Args[1]
 
+	// doctor 自行加载配置，配置文件有错误时也能诊断
+	if command != "doctor" {
+		cfg, err := loadConfig()
+		if err == nil {
+			err = applyConfig(cfg)
+		}
+		if err != nil {
+			fmt.Printf("加载配置失败: %v\n", err)
+			fmt.Println("运行 kiro2cc doctor 查看详细信息")
+			os.Exit(1)
+		}
+	}
+
 	switch command {
 	case "read":
 		readToken()
@@ -332,12 +357,36 @@ func main() {
 			port = os.Args[2]
 		}
 		startServer(port)
+	case "run":
+		code, err := runClient(os.Args[2:])
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(code)
+	case "doctor":
+		ok, err := runDoctor(os.Args[2:], os.Stdout)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+	case "usage":
+		if err := runUsage(os.Args[2:], os.Stdout); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
 	default:
 		fmt.Printf("未知命令: %s\n", command)
 		os.Exit(1)
 	}
 }
 
+// defaultAccount 默认 token 文件对应的上游账号名
+const defaultAccount = "default"
+
 // getTokenFilePath 获取跨平台的token文件路径
 func getTokenFilePath() string {
 	homeDir, err := os.UserHomeDir()
@@ -373,21 +422,42 @@ func readToken() {
 	}
 }
 
-// refreshToken 刷新token
+// refreshToken 刷新token并显示新的 access token
 func refreshToken() {
+	newToken, err := refreshAccessToken()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Token刷新成功!")
+	fmt.Printf("新的Access Token: %s\n", newToken.AccessToken)
+}
+
+// refreshAccessToken 使用 refresh token 刷新 access token 并写回 token 文件
+func refreshAccessToken() (TokenData, error) {
+	newToken, err := requestTokenRefresh()
+	accounts.recordRefresh(defaultAccount, err)
+	if err != nil {
+		tokenRefreshFailuresTotal.inc()
+		return TokenData{}, err
+	}
+	tokenRefreshesTotal.inc()
+	return newToken, nil
+}
+
+func requestTokenRefresh() (TokenData, error) {
 	tokenPath := getTokenFilePath()
 
 	// 读取当前token
 	data, err := os.ReadFile(tokenPath)
 	if err != nil {
-		fmt.Printf("读取token文件失败: %v\n", err)
-		os.Exit(1)
+		return TokenData{}, fmt.Errorf("读取token文件失败: %v", err)
 	}
 
 	var currentToken TokenData
 	if err := jsonStr.Unmarshal(data, &currentToken); err != nil {
-		fmt.Printf("解析token文件失败: %v\n", err)
-		os.Exit(1)
+		return TokenData{}, fmt.Errorf("解析token文件失败: %v", err)
 	}
 
 	// 准备刷新请求
@@ -397,33 +467,29 @@ func refreshToken() {
 
 	reqBody, err := jsonStr.Marshal(refreshReq)
 	if err != nil {
-		fmt.Printf("序列化请求失败: %v\n", err)
-		os.Exit(1)
+		return TokenData{}, fmt.Errorf("序列化请求失败: %v", err)
 	}
 
 	// 发送刷新请求
-	resp, err := http.Post(
-		"https://prod.us-east-1.auth.desktop.kiro.dev/refreshToken",
+	resp, err := upstreamClient().Post(
+		refreshTokenURL,
 		"application/json",
 		bytes.NewBuffer(reqBody),
 	)
 	if err != nil {
-		fmt.Printf("刷新token请求失败: %v\n", err)
-		os.Exit(1)
+		return TokenData{}, fmt.Errorf("刷新token请求失败: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("刷新token失败，状态码: %d, 响应: %s\n", resp.StatusCode, string(body))
-		os.Exit(1)
+		return TokenData{}, fmt.Errorf("刷新token失败，状态码: %d, 响应: %s", resp.StatusCode, string(body))
 	}
 
 	// 解析响应
 	var refreshResp RefreshResponse
 	if err := jsonStr.NewDecoder(resp.Body).Decode(&refreshResp); err != nil {
-		fmt.Printf("解析刷新响应失败: %v\n", err)
-		os.Exit(1)
+		return TokenData{}, fmt.Errorf("解析刷新响应失败: %v", err)
 	}
 
 	// 更新token文件
@@ -431,17 +497,14 @@ func refreshToken() {
 
 	newData, err := jsonStr.MarshalIndent(newToken, "", "  ")
 	if err != nil {
-		fmt.Printf("序列化新token失败: %v\n", err)
-		os.Exit(1)
+		return TokenData{}, fmt.Errorf("序列化新token失败: %v", err)
 	}
 
 	if err := os.WriteFile(tokenPath, newData, 0600); err != nil {
-		fmt.Printf("写入token文件失败: %v\n", err)
-		os.Exit(1)
+		return TokenData{}, fmt.Errorf("写入token文件失败: %v", err)
 	}
 
-	fmt.Println("Token刷新成功!")
-	fmt.Printf("新的Access Token: %s\n", newToken.AccessToken)
+	return newToken, nil
 }
 
 // exportEnvVars 导出环境变量
@@ -543,11 +606,27 @@ func getToken() (TokenData, error) {
 	return token, nil
 }
 
+// debugf 输出调试日志，设置环境变量 KIRO2CC_DEBUG=1 后启用
+func debugf(format string, args ...any) {
+	if os.Getenv("KIRO2CC_DEBUG") == "" {
+		return
+	}
+	log.Printf("[debug] "+format, args...)
+}
+
 // logMiddleware 记录所有HTTP请求的中间件
 func logMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		startTime := time.Now()
 
+		// 按路由统计，未知端点统一记为 other，避免标签数量无限增长
+		endpoint := r.Pattern
+		if endpoint == "" || endpoint == "/" {
+			endpoint = "other"
+		}
+		info := &requestInfo{Client: clientLabel(clientKey(r))}
+		recorder := &statusRecorder{ResponseWriter: w}
+
 		// fmt.Printf("\n=== 收到请求 ===\n")
 		// fmt.Printf("时间: %s\n", startTime.Format("2006-01-02 15:04:05"))
 		// fmt.Printf("请求方法: %s\n", r.Method)
@@ -558,389 +637,486 @@ func logMiddleware(next http.HandlerFunc) http.HandlerFunc {
 		// 	fmt.Printf("  %s: %s\n", name, strings.Join(values, ", "))
 		// }
 
+		ctx, span := startServerSpan(r, r.Method+" "+endpoint)
+		span.setAttr("http.method", r.Method)
+		span.setAttr("http.route", endpoint)
+		span.setAttr("client", info.Client)
+
 		// 调用下一个处理器
-		next(w, r)
+		requestsInFlight.add(1, endpoint)
+		next(recorder, r.WithContext(withRequestInfo(ctx, info)))
+		requestsInFlight.add(-1, endpoint)
 
 		// 计算处理时间
 		duration := time.Since(startTime)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		clientMetric := clientMetricLabel(clientKey(r), info.Client)
+		requestsTotal.inc(endpoint, modelLabel(info.Model), strconv.Itoa(status), clientMetric)
+		span.setAttr("http.status_code", status)
+		span.setAttr("model", info.Model)
+		if status >= http.StatusInternalServerError {
+			span.setError(fmt.Errorf("HTTP %d", status))
+		}
+		span.end()
+		if endpoint == "/v1/messages" {
+			recentRequests.add(requestRecord{
+				Time:         startTime,
+				RequestId:    recorder.Header().Get("request-id"),
+				Client:       info.Client,
+				Model:        info.Model,
+				Account:      info.Account,
+				Status:       status,
+				LatencyMs:    duration.Milliseconds(),
+				InputTokens:  info.InputTokens,
+				OutputTokens: info.OutputTokens,
+				StopReason:   info.StopReason,
+			})
+		}
+		if info.InputTokens > 0 || info.OutputTokens > 0 {
+			inputTokensTotal.add(float64(info.InputTokens), modelLabel(info.Model), clientMetric)
+			outputTokensTotal.add(float64(info.OutputTokens), modelLabel(info.Model), clientMetric)
+		}
 		fmt.Printf("处理时间: %v\n", duration)
 		fmt.Printf("=== 请求结束 ===\n\n")
 	}
 }
 
-// startServer 启动HTTP代理服务器
-func startServer(port string) {
+// newServer 创建代理服务器，注册所有端点并设置超时
+func newServer(addr string, cfg ServerConfig) *http.Server {
 	// 创建路由器
 	mux := http.NewServeMux()
 
 	// 注册所有端点
-	mux.HandleFunc("/v1/messages", logMiddleware(func(w http.ResponseWriter, r *http.Request) {
-		// 只处理POST请求
-		if r.Method != http.MethodPost {
-			fmt.Printf("错误: 不支持的请求方法\n")
-			http.Error(w, "只支持POST请求", http.StatusMethodNotAllowed)
-			return
-		}
-
-		// 获取当前token
-		token, err := getToken()
-		if err != nil {
-			fmt.Printf("错误: 获取token失败: %v\n", err)
-			http.Error(w, fmt.Sprintf("获取token失败: %v", err), http.StatusInternalServerError)
-			return
-		}
-
-		// 读取请求体
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			fmt.Printf("错误: 读取请求体失败: %v\n", err)
-			http.Error(w, fmt.Sprintf("读取请求体失败: %v", err), http.StatusInternalServerError)
-			return
-		}
-		defer r.Body.Close()
-
-		fmt.Printf("\n=========================Anthropic 请求体:\n%s\n=======================================\n", string(body))
-
-		// 解析 Anthropic 请求
-		var anthropicReq AnthropicRequest
-		if err := jsonStr.Unmarshal(body, &anthropicReq); err != nil {
-			fmt.Printf("错误: 解析请求体失败: %v\n", err)
-			http.Error(w, fmt.Sprintf("解析请求体失败: %v", err), http.StatusBadRequest)
-			return
-		}
-
-		// 如果是流式请求
-		if anthropicReq.Stream {
-			handleStreamRequest(w, anthropicReq, token.AccessToken)
-			return
-		}
-
-		// 非流式请求处理
-		handleNonStreamRequest(w, anthropicReq, token.AccessToken)
-	}))
+	mux.HandleFunc("/v1/messages", logMiddleware(handleMessages))
 
 	// 添加健康检查端点
+	mux.HandleFunc("/metrics", handleMetrics)
+	registerAdminRoutes(mux)
+	registerUIRoutes(mux)
 	mux.HandleFunc("/health", logMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	}))
+	mux.HandleFunc("/health/live", logMiddleware(handleLiveness))
+	mux.HandleFunc("/health/ready", logMiddleware(handleReadiness))
 
 	// 添加404处理
 	mux.HandleFunc("/", logMiddleware(func(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("警告: 访问未知端点\n")
-		http.Error(w, "404 未找到", http.StatusNotFound)
+		writeAnthropicError(w, newAnthropicError(http.StatusNotFound, "Not found: %s %s", r.Method, r.URL.Path))
 	}))
 
+	return &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+	}
+}
+
+// startServer 启动HTTP代理服务器，收到 SIGINT/SIGTERM 后等待进行中的请求结束再退出
+func startServer(port string) {
+	cfg := config().Server
+	server := newServer(":"+port, cfg)
+
+	shutdownTracing, err := setupTracing(config().Tracing)
+	if err != nil {
+		fmt.Printf("开启链路追踪失败: %v\n", err)
+		os.Exit(1)
+	}
+
+	_, adminTokenPath, err := ensureAdminToken()
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
 	// 启动服务器
 	fmt.Printf("启动Anthropic API代理服务器，监听端口: %s\n", port)
 	fmt.Printf("可用端点:\n")
 	fmt.Printf("  POST /v1/messages - Anthropic API代理\n")
 	fmt.Printf("  GET  /health      - 健康检查\n")
+	fmt.Printf("  GET  /health/ready - 就绪检查\n")
+	fmt.Printf("  GET  /metrics     - Prometheus 指标\n")
+	fmt.Printf("  GET  /admin/status - 管理接口\n")
+	fmt.Printf("  GET  /ui          - 管理页面\n")
+	// 不输出 token 原文，避免写入日志
+	fmt.Printf("管理页面: http://localhost:%s/ui/\n", port)
+	if adminTokenPath != "" {
+		fmt.Printf("管理 token 保存在 %s，打开管理页面时输入\n", adminTokenPath)
+	} else {
+		fmt.Printf("管理 token 为配置文件中的 admin.token\n")
+	}
 	fmt.Printf("按Ctrl+C停止服务器\n")
 
-	if err := http.ListenAndServe(":"+port, mux); err != nil {
+	select {
+	case err := <-serveErr:
 		fmt.Printf("启动服务器失败: %v\n", err)
 		os.Exit(1)
+	case <-ctx.Done():
+		// 再次按 Ctrl+C 时直接退出
+		stop()
+		fmt.Printf("\n正在停止服务器，等待 %d 个进行中的流式响应结束（最长 %v）...\n",
+			activeStreams.count(), time.Duration(cfg.ShutdownTimeout))
+		shutdownServer(server, time.Duration(cfg.ShutdownTimeout))
+
+		// 发送尚未导出的 span
+		tracingCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer cancel()
+		if err := shutdownTracing(tracingCtx); err != nil {
+			fmt.Printf("导出追踪数据失败: %v\n", err)
+		}
 	}
 }
 
-// handleStreamRequest 处理流式请求
-func handleStreamRequest(w http.ResponseWriter, anthropicReq AnthropicRequest, accessToken string) {
-	// 设置SSE headers
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+// handleMessages 处理 /v1/messages 请求
+func handleMessages(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	requestId := newRequestId()
+	w.Header().Set("request-id", requestId)
+	r, info := ensureRequestInfo(r)
+
+	// 只处理POST请求
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAnthropicError(w, newAnthropicError(http.StatusMethodNotAllowed, "Method %s not allowed, only POST is supported", r.Method))
 		return
 	}
 
-	messageId := fmt.Sprintf("msg_%s", time.Now().Format("20060102150405"))
-
-	// 构建 CodeWhisperer 请求
-	cwReq := buildCodeWhispererRequest(anthropicReq)
-
-	// 序列化请求体
-	cwReqBody, err := jsonStr.Marshal(cwReq)
+	// 选择处理请求的上游账号
+	account, err := accounts.pick()
 	if err != nil {
-		sendErrorEvent(w, flusher, "序列化请求失败", err)
+		writeAnthropicError(w, newAnthropicError(statusOverloaded, "%v", err))
 		return
 	}
+	info.Account = account
 
-	// fmt.Printf("CodeWhisperer 流式请求体:\n%s\n", string(cwReqBody))
+	// 获取当前token
+	_, tokenSpan := startSpan(r.Context(), "getToken")
+	token, err := getToken()
+	tokenSpan.setError(err)
+	tokenSpan.end()
+	if err != nil {
+		writeAnthropicError(w, newAnthropicError(http.StatusUnauthorized, "Failed to load Kiro token: %v", err))
+		return
+	}
 
-	// 创建流式请求
-	proxyReq, err := http.NewRequest(
-		http.MethodPost,
-		"https://codewhisperer.us-east-1.amazonaws.com/generateAssistantResponse",
-		bytes.NewBuffer(cwReqBody),
-	)
+	// 读取请求体
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		sendErrorEvent(w, flusher, "创建代理请求失败", err)
+		writeAnthropicError(w, newAnthropicError(http.StatusBadRequest, "Failed to read request body: %v", err))
 		return
 	}
+	defer r.Body.Close()
 
-	// 设置请求头
-	proxyReq.Header.Set("Authorization", "Bearer "+accessToken)
-	proxyReq.Header.Set("Content-Type", "application/json")
-	proxyReq.Header.Set("Accept", "text/event-stream")
+	fmt.Printf("\n=========================Anthropic 请求体:\n%s\n=======================================\n", string(body))
 
-	// 发送请求
-	client := &http.Client{}
+	// 解析 Anthropic 请求
+	var anthropicReq AnthropicRequest
+	if err := jsonStr.Unmarshal(body, &anthropicReq); err != nil {
+		writeAnthropicError(w, newAnthropicError(http.StatusBadRequest, "Invalid request body: %v", err))
+		return
+	}
+	info.Model = anthropicReq.Model
 
-	resp, err := client.Do(proxyReq)
-	if err != nil {
-		sendErrorEvent(w, flusher, "CodeWhisperer reqeust error", fmt.Errorf("reqeust error: %s", err.Error()))
+	if err := validateToolChoice(anthropicReq); err != nil {
+		writeAnthropicError(w, newAnthropicError(http.StatusBadRequest, "%v", err))
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Printf("CodeWhisperer 响应错误，状态码: %d, 响应: %s\n", resp.StatusCode, string(body))
-		sendErrorEvent(w, flusher, "error", fmt.Errorf("状态码: %d", resp.StatusCode))
-
-		if resp.StatusCode == 403 {
-			refreshToken()
-			sendErrorEvent(w, flusher, "error", fmt.Errorf("CodeWhisperer Token 已刷新，请重试"))
-		} else {
-			sendErrorEvent(w, flusher, "error", fmt.Errorf("CodeWhisperer Error: %s ", string(body)))
-		}
+	// 超出上游上下文上限时截断最早的历史对话
+	anthropicReq, dropped, overBudget := truncateHistory(anthropicReq)
+	if dropped > 0 {
+		w.Header().Set(truncatedTurnsHeader, strconv.Itoa(dropped))
+	}
+	if overBudget {
+		w.Header().Set(contextOverBudgetHeader, "true")
+	}
+
+	// 检查客户端预算并预扣本次请求，请求结束后按实际用量结算，失败的请求退还。
+	// 预算在限流之前检查，超出预算被拒绝的请求不占用限流额度
+	estimatedTokens := estimateInputTokens(anthropicReq)
+	warnings, reservation, budgetErr := budgets.check(clientKey(r), info.Client, estimatedTokens)
+	for _, warning := range warnings {
+		w.Header().Add(budgetWarningHeader, warning)
+	}
+	if budgetErr != nil {
+		writeAnthropicError(w, budgetErr)
 		return
 	}
+	defer func() { reservation.settle(info.InputTokens+info.OutputTokens, info.StopReason != "") }()
 
-	// 先读取整个响应体
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		sendErrorEvent(w, flusher, "error", fmt.Errorf("CodeWhisperer Error 读取响应失败"))
+	// 检查客户端和全局限额，请求结束后释放并发数并补扣输出 token
+	release, limitStatus, limitErr := activeRateLimiter().acquire(info.Client, estimatedTokens)
+	limitStatus.writeHeaders(w.Header())
+	if limitErr != nil {
+		writeRateLimitError(w, limitErr)
 		return
 	}
+	defer func() { release(info.OutputTokens) }()
 
-	// os.WriteFile(messageId+"response.raw", respBody, 0644)
-
-	// 使用新的CodeWhisperer解析器
-	events := parser.ParseEvents(respBody)
-
-	if len(events) > 0 {
-
-		// 发送开始事件
-		messageStart := map[string]any{
-			"type": "message_start",
-			"message": map[string]any{
-				"id":            messageId,
-				"type":          "message",
-				"role":          "assistant",
-				"content":       []any{},
-				"model":         anthropicReq.Model,
-				"stop_reason":   nil,
-				"stop_sequence": nil,
-				"usage": map[string]any{
-					"input_tokens":  len(getMessageContent(anthropicReq.Messages[0].Content)),
-					"output_tokens": 1,
-				},
-			},
+	// 成功完成的请求写入用量账本
+	defer func() {
+		if info.StopReason == "" {
+			return
 		}
-		sendSSEEvent(w, flusher, "message_start", messageStart)
-		sendSSEEvent(w, flusher, "ping", map[string]string{
-			"type": "ping",
+		err := appendUsage(usageRecord{
+			Time:         time.Now().UTC(),
+			RequestId:    requestId,
+			Client:       info.Client,
+			Model:        info.Model,
+			Stream:       anthropicReq.Stream,
+			InputTokens:  info.InputTokens,
+			OutputTokens: info.OutputTokens,
+			LatencyMs:    time.Since(startTime).Milliseconds(),
+			StopReason:   info.StopReason,
+			Account:      info.Account,
 		})
-
-		contentBlockStart := map[string]any{
-			"content_block": map[string]any{
-				"text": "",
-				"type": "text"},
-			"index": 0, "type": "content_block_start",
+		if err != nil {
+			log.Printf("写入用量账本失败: %v", err)
 		}
+	}()
 
-		sendSSEEvent(w, flusher, "content_block_start", contentBlockStart)
-		// 处理解析出的事件
+	// 如果是流式请求
+	if anthropicReq.Stream {
+		handleStreamRequest(r.Context(), w, anthropicReq, token.AccessToken)
+		return
+	}
 
-		outputTokens := 0
-		for _, e := range events {
-			sendSSEEvent(w, flusher, e.Event, e.Data)
+	// 非流式请求处理
+	handleNonStreamRequest(r.Context(), w, anthropicReq, token.AccessToken)
+}
 
-			if e.Event == "content_block_delta" {
-				outputTokens = len(getMessageContent(e.Data))
-			}
+// handleStreamRequest 处理流式请求。开始向客户端输出事件前发生的错误以 HTTP 错误响应返回，
+// 之后发生的错误以 error 事件返回。客户端断开连接时 ctx 被取消，上游请求随之中断
+func handleStreamRequest(ctx context.Context, w http.ResponseWriter, anthropicReq AnthropicRequest, accessToken string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAnthropicError(w, newAnthropicError(http.StatusInternalServerError, "Streaming unsupported"))
+		return
+	}
 
-			// 随机延时
-			time.Sleep(time.Duration(rand.Intn(300)) * time.Millisecond)
-		}
+	message := newMessage(anthropicReq)
+
+	// 登记进行中的流式响应，服务器退出时通过 cancelStream 中断
+	ctx, cancelStream := context.WithCancelCause(ctx)
+	defer cancelStream(nil)
+	info := requestInfoFrom(ctx)
+	defer activeStreams.add(&activeStream{
+		Id:        message.Id,
+		Model:     anthropicReq.Model,
+		Client:    info.Client,
+		Account:   info.Account,
+		StartedAt: time.Now(),
+		cancel:    cancelStream,
+	})()
+
+	// 命中 stop sequence 或 max_tokens 后通过 cancel 中断上游连接
+	upstreamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-		contentBlockStop := map[string]any{
-			"index": 0,
-			"type":  "content_block_stop",
+	// 发送请求
+	source, err := openEventStream(upstreamCtx, anthropicReq, accessToken)
+	if err != nil {
+		if apiErr := streamCancelError(ctx); apiErr != nil {
+			writeAnthropicError(w, apiErr)
+			return
 		}
-		sendSSEEvent(w, flusher, "content_block_stop", contentBlockStop)
-
-		contentBlockStopReason := map[string]any{
-			"type": "message_delta", "delta": map[string]any{"stop_reason": "end_turn", "stop_sequence": nil}, "usage": map[string]any{
-				"output_tokens": outputTokens,
-			},
+		if ctx.Err() != nil {
+			log.Printf("客户端已断开连接，取消上游请求: %v", ctx.Err())
+			return
 		}
-		sendSSEEvent(w, flusher, "message_delta", contentBlockStopReason)
 
-		messageStop := map[string]any{
-			"type": "message_stop",
+		apiErr := toAnthropicError(err)
+
+		var upstreamErr *upstreamError
+		if errors.As(err, &upstreamErr) && upstreamErr.StatusCode == http.StatusForbidden {
+			if _, err := refreshAccessToken(); err != nil {
+				log.Printf("刷新 token 失败: %v", err)
+				apiErr.Message += " (CodeWhisperer token refresh failed)"
+			} else {
+				apiErr.Message += " (CodeWhisperer token refreshed, please retry)"
+			}
 		}
-		sendSSEEvent(w, flusher, "message_stop", messageStop)
+
+		writeAnthropicError(w, apiErr)
+		return
 	}
+	defer source.Close()
 
-}
+	info.InputTokens = message.Usage.InputTokens
+	defer streamDurationSeconds.observeSince(time.Now(), modelLabel(anthropicReq.Model))
 
-// handleNonStreamRequest 处理非流式请求
-func handleNonStreamRequest(w http.ResponseWriter, anthropicReq AnthropicRequest, accessToken string) {
-	// 构建 CodeWhisperer 请求
-	cwReq := buildCodeWhispererRequest(anthropicReq)
+	// 设置SSE headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	// 序列化请求体
-	cwReqBody, err := jsonStr.Marshal(cwReq)
-	if err != nil {
-		fmt.Printf("错误: 序列化请求失败: %v\n", err)
-		http.Error(w, fmt.Sprintf("序列化请求失败: %v", err), http.StatusInternalServerError)
+	// 发送开始事件
+	message.Usage.OutputTokens = 1
+	messageStart := map[string]any{
+		"type":    "message_start",
+		"message": message,
+	}
+	sendSSEEvent(w, flusher, "message_start", messageStart)
+	sendSSEEvent(w, flusher, "ping", map[string]string{
+		"type": "ping",
+	})
+
+	// 边读取边解析上游响应
+	translator := newResponseTranslator(anthropicReq, func(eventType string, data any) {
+		sendSSEEvent(w, flusher, eventType, data)
+	})
+	translateEvents(ctx, source, translator)
+	cancel()
+	info.OutputTokens = translator.outputTokens()
+	if apiErr := streamCancelError(ctx); apiErr != nil {
+		apiErr.Message += ", the response was cut off"
+		sendErrorEvent(w, flusher, apiErr)
+		return
+	}
+	if ctx.Err() != nil {
+		log.Printf("客户端已断开连接，停止转发响应: %v", ctx.Err())
 		return
 	}
 
-	// fmt.Printf("CodeWhisperer 请求体:\n%s\n", string(cwReqBody))
-
-	// 创建请求
-	proxyReq, err := http.NewRequest(
-		http.MethodPost,
-		"https://codewhisperer.us-east-1.amazonaws.com/generateAssistantResponse",
-		bytes.NewBuffer(cwReqBody),
-	)
-	if err != nil {
-		fmt.Printf("错误: 创建代理请求失败: %v\n", err)
-		http.Error(w, fmt.Sprintf("创建代理请求失败: %v", err), http.StatusInternalServerError)
+	stopReason := translator.finish()
+	if translator.err != nil {
+		sendErrorEvent(w, flusher, toAnthropicError(translator.err))
 		return
 	}
+	// 上游在事件流中返回异常时已输出的内容不完整，不能以正常的 stop_reason 结束
+	if apiErr := exceptionToAnthropicError(translator.exception); apiErr != nil {
+		sendErrorEvent(w, flusher, apiErr)
+		return
+	}
+	info.StopReason = stopReason
+	sendSSEEvent(w, flusher, "message_delta", translator.messageDelta())
+
+	messageStop := map[string]any{
+		"type": "message_stop",
+	}
+	sendSSEEvent(w, flusher, "message_stop", messageStop)
+}
 
-	// 设置请求头
-	proxyReq.Header.Set("Authorization", "Bearer "+accessToken)
-	proxyReq.Header.Set("Content-Type", "application/json")
+// handleNonStreamRequest 处理非流式请求
+func handleNonStreamRequest(ctx context.Context, w http.ResponseWriter, anthropicReq AnthropicRequest, accessToken string) {
+	// 提前结束时取消上游连接
+	upstreamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	// 发送请求
-	client := &http.Client{}
-
-	resp, err := client.Do(proxyReq)
+	source, err := openEventStream(upstreamCtx, anthropicReq, accessToken)
 	if err != nil {
-		fmt.Printf("错误: 发送请求失败: %v\n", err)
-		http.Error(w, fmt.Sprintf("发送请求失败: %v", err), http.StatusInternalServerError)
+		if ctx.Err() != nil {
+			log.Printf("客户端已断开连接，取消上游请求: %v", ctx.Err())
+			return
+		}
+		writeAnthropicError(w, toAnthropicError(err))
 		return
 	}
-	defer resp.Body.Close()
-
-	// 读取响应
-	cwRespBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		fmt.Printf("错误: 读取响应失败: %v\n", err)
-		http.Error(w, fmt.Sprintf("读取响应失败: %v", err), http.StatusInternalServerError)
+	defer source.Close()
+
+	collector := newContentCollector()
+	translator := newResponseTranslator(anthropicReq, collector.collect)
+	translateEvents(ctx, source, translator)
+	cancel()
+	if ctx.Err() != nil {
+		log.Printf("客户端已断开连接，丢弃响应: %v", ctx.Err())
 		return
 	}
+	stopReason := translator.finish()
 
-	// fmt.Printf("CodeWhisperer 响应体:\n%s\n", string(cwRespBody))
-
-	respBodyStr := string(cwRespBody)
-
-	events := parser.ParseEvents(cwRespBody)
-
-	context := ""
-	toolName := ""
-	toolUseId := ""
-
-	contexts := []map[string]any{}
-
-	partialJsonStr := ""
-	for _, event := range events {
-		if event.Data != nil {
-			if dataMap, ok := event.Data.(map[string]any); ok {
-				switch dataMap["type"] {
-				case "content_block_start":
-					context = ""
-				case "content_block_delta":
-					if delta, ok := dataMap["delta"]; ok {
-
-						if deltaMap, ok := delta.(map[string]any); ok {
-							switch deltaMap["type"] {
-							case "text_delta":
-								if text, ok := deltaMap["text"]; ok {
-									context += text.(string)
-								}
-							case "input_json_delta":
-								toolUseId = deltaMap["id"].(string)
-								toolName = deltaMap["name"].(string)
-								if partial_json, ok := deltaMap["partial_json"]; ok {
-									if strPtr, ok := partial_json.(*string); ok && strPtr != nil {
-										partialJsonStr = partialJsonStr + *strPtr
-									} else if str, ok := partial_json.(string); ok {
-										partialJsonStr = partialJsonStr + str
-									} else {
-										log.Println("partial_json is not string or *string")
-									}
-								} else {
-									log.Println("partial_json not found")
-								}
-
-							}
-						}
-					}
-
-				case "content_block_stop":
-					if index, ok := dataMap["index"]; ok {
-						switch index {
-						case 1:
-							toolInput := map[string]interface{}{}
-							if err := jsonStr.Unmarshal([]byte(partialJsonStr), &toolInput); err != nil {
-								log.Printf("json unmarshal error:%s", err.Error())
-							}
-
-							contexts = append(contexts, map[string]interface{}{
-								"type":  "tool_use",
-								"id":    toolUseId,
-								"name":  toolName,
-								"input": toolInput,
-							})
-						case 0:
-							contexts = append(contexts, map[string]interface{}{
-								"text": context,
-								"type": "text",
-							})
-						}
-					}
-				}
-
-			}
-		}
+	if translator.err != nil {
+		writeAnthropicError(w, toAnthropicError(translator.err))
+		return
 	}
-	// 检查是否是错误响应
-	if strings.Contains(string(cwRespBody), "Improperly formed request.") {
-		fmt.Printf("错误: CodeWhisperer返回格式错误: %s\n", respBodyStr)
-		http.Error(w, fmt.Sprintf("请求格式错误: %s", respBodyStr), http.StatusBadRequest)
+
+	// 上游在事件流中返回异常时已收到的内容不完整，与流式响应一样返回错误，客户端可以据此重试
+	if apiErr := exceptionToAnthropicError(translator.exception); apiErr != nil {
+		writeAnthropicError(w, apiErr)
 		return
 	}
 
 	// 构建 Anthropic 响应
-	anthropicResp := map[string]any{
-		"content":       contexts,
-		"model":         anthropicReq.Model,
-		"role":          "assistant",
-		"stop_reason":   "end_turn",
-		"stop_sequence": nil,
-		"type":          "message",
-		"usage": map[string]any{
-			"input_tokens":  len(cwReq.ConversationState.CurrentMessage.UserInputMessage.Content),
-			"output_tokens": len(context),
-		},
-	}
+	anthropicResp := newMessage(anthropicReq)
+	anthropicResp.Content = collector.blocks
+	anthropicResp.StopReason = &stopReason
+	anthropicResp.StopSequence = translator.stopSequence
+	anthropicResp.Usage.OutputTokens = translator.outputTokens()
+
+	info := requestInfoFrom(ctx)
+	info.InputTokens = anthropicResp.Usage.InputTokens
+	info.OutputTokens = anthropicResp.Usage.OutputTokens
+	info.StopReason = stopReason
 
 	// 发送响应
 	w.Header().Set("Content-Type", "application/json")
 	jsonStr.NewEncoder(w).Encode(anthropicResp)
 }
 
+// translateEvents 从事件源读取事件交给转换器，直到读取完毕、转换器提前结束或 ctx 被取消。
+// 读取和解码上游帧记录在子 span decodeEvents 中，转换并写出客户端事件记录在子 span writeEvents 中，
+// 两者交替进行，busy_ms 属性为各自实际耗时之和
+func translateEvents(ctx context.Context, source eventSource, translator *responseTranslator) {
+	ctx, translateSpan := startSpan(ctx, "translateEvents")
+	defer translateSpan.end()
+
+	start := time.Now()
+	_, decodeSpan := startSpan(ctx, "decodeEvents")
+	var writeSpan *span
+	var readTime, writeTime time.Duration
+	events := 0
+	defer func() {
+		translateSpan.setAttr("events", events)
+		decodeSpan.setAttr("events", events)
+		decodeSpan.setAttr("busy_ms", readTime.Milliseconds())
+		decodeSpan.end()
+		writeSpan.setAttr("events", events)
+		writeSpan.setAttr("busy_ms", writeTime.Milliseconds())
+		writeSpan.end()
+	}()
+
+	for !translator.stopped() && ctx.Err() == nil {
+		readStart := time.Now()
+		e, err := source.Next()
+		readTime += time.Since(readStart)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Printf("读取 CodeWhisperer 响应失败: %v", err)
+				decodeSpan.setError(err)
+				translateSpan.setError(err)
+			}
+			return
+		}
+
+		if events == 0 {
+			translateSpan.setAttr("first_event_ms", time.Since(start).Milliseconds())
+			_, writeSpan = startSpan(ctx, "writeEvents")
+		}
+		events++
+
+		writeStart := time.Now()
+		translator.handle(e)
+		writeTime += time.Since(writeStart)
+	}
+}
+
 // sendSSEEvent 发送 SSE 事件
 func sendSSEEvent(w http.ResponseWriter, flusher http.Flusher, eventType string, data any) {
 
@@ -959,18 +1135,10 @@ func sendSSEEvent(w http.ResponseWriter, flusher http.Flusher, eventType string,
 }
 
 // sendErrorEvent 发送错误事件
-func sendErrorEvent(w http.ResponseWriter, flusher http.Flusher, message string, err error) {
-	errorResp := map[string]any{
-		"type": "error",
-		"error": map[string]any{
-			"type":    "overloaded_error",
-			"message": message,
-		},
-	}
-
+func sendErrorEvent(w http.ResponseWriter, flusher http.Flusher, apiErr *anthropicError) {
 	// data: {"type": "error", "error": {"type": "overloaded_error", "message": "Overloaded"}}
-
-	sendSSEEvent(w, flusher, "error", errorResp)
+	recordError(w, apiErr)
+	sendSSEEvent(w, flusher, "error", apiErr.body())
 }
 
 func FileExists(path string) (bool, error) {
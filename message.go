@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// AnthropicMessage 表示 Anthropic Messages API 返回的消息，
+// 非流式响应直接返回，流式响应在 message_start 事件中返回
+type AnthropicMessage struct {
+	Id           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []map[string]any `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        AnthropicUsage   `json:"usage"`
+}
+
+// AnthropicUsage 表示消息的 token 用量，CodeWhisperer 不返回用量，均为估算值
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// newMessage 创建一条空的 assistant 消息
+func newMessage(anthropicReq AnthropicRequest) AnthropicMessage {
+	return AnthropicMessage{
+		Id:      newMessageId(),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   anthropicReq.Model,
+		Content: []map[string]any{},
+		Usage: AnthropicUsage{
+			InputTokens: estimateInputTokens(anthropicReq),
+		},
+	}
+}
+
+// estimateInputTokens 估算请求的输入 token 数
+func estimateInputTokens(anthropicReq AnthropicRequest) int {
+	return estimateRequestTokens(anthropicReq.System, anthropicReq.Tools, anthropicReq.Messages)
+}
+
+// base62Chars Anthropic 风格 ID 使用的字符集
+const base62Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// randomBase62 生成长度为 n 的随机 base62 字符串
+func randomBase62(n int) string {
+	b := make([]byte, n)
+	max := big.NewInt(int64(len(base62Chars)))
+	for i := range b {
+		v, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = base62Chars[v.Int64()]
+	}
+	return string(b)
+}
+
+// newMessageId 生成 Anthropic 格式的消息 ID，如 msg_01XFDUDYJgAACzvnptvVoYEL
+func newMessageId() string {
+	return "msg_01" + randomBase62(22)
+}
+
+// newToolUseId 生成 Anthropic 格式的工具调用 ID
+func newToolUseId() string {
+	return "toolu_01" + randomBase62(22)
+}
+
+// newRequestId 生成返回在 request-id 响应头中的请求 ID
+func newRequestId() string {
+	return "req_01" + randomBase62(22)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	jsonStr "encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// setupFakeUpstream 使用 parser 的 response.raw 作为上游响应，并准备一个临时 token 文件
+func setupFakeUpstream(t *testing.T) {
+	t.Helper()
+
+	raw, err := os.ReadFile(filepath.Join("parser", "response.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write(raw)
+	}))
+	t.Cleanup(upstream.Close)
+
+	originalURL := codeWhispererURL
+	codeWhispererURL = upstream.URL
+	t.Cleanup(func() { codeWhispererURL = originalURL })
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	tokenDir := filepath.Join(home, ".aws", "sso", "cache")
+	if err := os.MkdirAll(tokenDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	token := `{"accessToken":"test-token","refreshToken":"refresh"}`
+	if err := os.WriteFile(filepath.Join(tokenDir, "kiro-auth-token.json"), []byte(token), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func messagesRequest(stream bool) *http.Request {
+	body := map[string]any{
+		"model":      "claude-sonnet-4-20250514",
+		"max_tokens": 1024,
+		"stream":     stream,
+		"messages":   []any{map[string]any{"role": "user", "content": "read /tmp/a.txt"}},
+		"tools": []any{map[string]any{
+			"name":         "Read",
+			"description":  "Read a file",
+			"input_schema": map[string]any{"type": "object", "required": []any{"file_path"}},
+		}},
+	}
+	data, _ := jsonStr.Marshal(body)
+	return httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(string(data)))
+}
+
+func sortedKeys(m map[string]any) string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// checkMessageEnvelope 校验消息结构符合 Anthropic Message schema
+func checkMessageEnvelope(t *testing.T, msg map[string]any) {
+	t.Helper()
+
+	if got, want := sortedKeys(msg), "content,id,model,role,stop_reason,stop_sequence,type,usage"; got != want {
+		t.Fatalf("message keys = %s, want %s", got, want)
+	}
+	if id, _ := msg["id"].(string); !strings.HasPrefix(id, "msg_") || len(id) != 28 {
+		t.Fatalf("invalid message id %q", msg["id"])
+	}
+	if msg["type"] != "message" || msg["role"] != "assistant" || msg["model"] != "claude-sonnet-4-20250514" {
+		t.Fatalf("invalid message envelope: %v", msg)
+	}
+	if _, ok := msg["content"].([]any); !ok {
+		t.Fatalf("content must be an array: %v", msg["content"])
+	}
+	usage, ok := msg["usage"].(map[string]any)
+	if !ok || sortedKeys(usage) != "input_tokens,output_tokens" {
+		t.Fatalf("invalid usage: %v", msg["usage"])
+	}
+	if _, ok := usage["input_tokens"].(float64); !ok {
+		t.Fatalf("input_tokens must be a number: %v", usage)
+	}
+}
+
+func TestMessagesContractNonStream(t *testing.T) {
+	setupFakeUpstream(t)
+
+	w := httptest.NewRecorder()
+	handleMessages(w, messagesRequest(false))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if !strings.HasPrefix(w.Header().Get("request-id"), "req_") {
+		t.Fatalf("missing request-id header: %v", w.Header())
+	}
+
+	var msg map[string]any
+	if err := jsonStr.Unmarshal(w.Body.Bytes(), &msg); err != nil {
+		t.Fatal(err)
+	}
+	checkMessageEnvelope(t, msg)
+
+	if msg["stop_reason"] != "tool_use" || msg["stop_sequence"] != nil {
+		t.Fatalf("stop_reason = %v, stop_sequence = %v", msg["stop_reason"], msg["stop_sequence"])
+	}
+
+	content := msg["content"].([]any)
+	if len(content) != 2 {
+		t.Fatalf("got %d content blocks, want 2: %v", len(content), content)
+	}
+	text := content[0].(map[string]any)
+	if sortedKeys(text) != "text,type" || text["text"] != "Let me check the file." {
+		t.Fatalf("invalid text block: %v", text)
+	}
+	tool := content[1].(map[string]any)
+	if sortedKeys(tool) != "id,input,name,type" || !strings.HasPrefix(tool["id"].(string), "toolu_") {
+		t.Fatalf("invalid tool_use block: %v", tool)
+	}
+	if input := tool["input"].(map[string]any); input["file_path"] != "/tmp/a.txt" {
+		t.Fatalf("invalid tool input: %v", input)
+	}
+}
+
+func TestMessagesContractStream(t *testing.T) {
+	setupFakeUpstream(t)
+
+	w := httptest.NewRecorder()
+	handleMessages(w, messagesRequest(true))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	var events []string
+	var datas []map[string]any
+	scanner := bufio.NewScanner(w.Body)
+	var event string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var data map[string]any
+			if err := jsonStr.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+				t.Fatal(err)
+			}
+			if data["type"] != event {
+				t.Fatalf("event %q has data type %v", event, data["type"])
+			}
+			events = append(events, event)
+			datas = append(datas, data)
+		}
+	}
+
+	want := []string{
+		"message_start", "ping",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta", "message_stop",
+	}
+	if strings.Join(events, ",") != strings.Join(want, ",") {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+
+	checkMessageEnvelope(t, datas[0]["message"].(map[string]any))
+
+	delta := datas[9]["delta"].(map[string]any)
+	if delta["stop_reason"] != "tool_use" {
+		t.Fatalf("final stop_reason = %v, want tool_use", delta["stop_reason"])
+	}
+	if block := datas[6]["content_block"].(map[string]any); block["type"] != "tool_use" || datas[6]["index"] != float64(1) {
+		t.Fatalf("invalid tool_use block start: %v", datas[6])
+	}
+}
+
+func TestIdsAreUnique(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := newMessageId()
+		if seen[id] {
+			t.Fatalf("duplicate message id %s", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric 表示可以按 Prometheus 文本格式输出的指标
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+// metricsRegistry 所有已注册的指标，按注册顺序输出
+var metricsRegistry []metric
+
+// registerMetric 注册指标
+func registerMetric[M metric](m M) M {
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+// labelKey 将标签值拼接为内部使用的 key
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\x00")
+}
+
+// formatLabels 将标签名和以 labelKey 拼接的标签值格式化为 {a="x",b="y"}，extra 为额外追加的标签
+func formatLabels(names []string, key string, extra ...string) string {
+	var values []string
+	if len(names) > 0 {
+		values = strings.Split(key, "\x00")
+	}
+
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabelValue(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabelValue(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelValueEscaper Prometheus 文本格式的标签值只允许转义反斜杠、双引号和换行
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabelValue 转义标签值，其他字符（包括非 ASCII 字符）原样输出
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+// modelLabel 返回指标中使用的模型标签。模型名来自客户端，不在 ModelMap 中的模型统一记为 other，
+// 避免标签数量无限增长
+func modelLabel(model string) string {
+	if _, ok := ModelMap[model]; ok || model == "" {
+		return model
+	}
+	return "other"
+}
+
+// clientMetricLabel 返回指标中使用的客户端标签。客户端 key 来自请求，只有在 budgets.keys 中
+// 按 key 原文或客户端标识配置过的客户端单独记录，其他客户端统一记为 other，避免标签数量无限增长
+func clientMetricLabel(key, client string) string {
+	if client == clientLabel("") {
+		return client
+	}
+	keys := config().Budgets.Keys
+	for _, name := range []string{key, client} {
+		if _, ok := keys[name]; ok && name != "" {
+			return client
+		}
+	}
+	return "other"
+}
+
+// formatFloat 按 Prometheus 的格式输出数值
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeHeader 输出指标的 HELP 和 TYPE 行
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// sortedLabelKeys 返回排序后的标签 key，保证输出顺序稳定
+func sortedLabelKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// counterVec 按标签值分别计数的计数器
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newCounterVec 创建计数器，labels 为标签名
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return registerMetric(&counterVec{name: name, help: help, labels: labels, values: map[string]float64{}})
+}
+
+// inc 将指定标签值的计数加一，标签值顺序与 labels 一致
+func (c *counterVec) inc(labelValues ...string) {
+	c.add(1, labelValues...)
+}
+
+// add 将指定标签值的计数增加 v
+func (c *counterVec) add(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+// value 返回指定标签值的当前计数
+func (c *counterVec) value(labelValues ...string) float64 {
+	key := labelKey(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, key := range sortedLabelKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key), formatFloat(c.values[key]))
+	}
+}
+
+// gaugeVec 按标签值分别记录的当前值，如进行中的请求数
+type gaugeVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// newGaugeVec 创建 gauge，labels 为标签名
+func newGaugeVec(name, help string, labels ...string) *gaugeVec {
+	return registerMetric(&gaugeVec{name: name, help: help, labels: labels, values: map[string]float64{}})
+}
+
+// add 将指定标签值的当前值增加 v，v 可以为负数
+func (g *gaugeVec) add(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	g.mu.Lock()
+	g.values[key] += v
+	g.mu.Unlock()
+}
+
+// snapshot 返回所有标签值的当前值，key 为以 labelKey 拼接的标签值
+func (g *gaugeVec) snapshot() map[string]float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	values := make(map[string]float64, len(g.values))
+	for key, v := range g.values {
+		values[key] = v
+	}
+	return values
+}
+
+func (g *gaugeVec) writeTo(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, key := range sortedLabelKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, key), formatFloat(g.values[key]))
+	}
+}
+
+// gaugeFunc 输出时调用函数取值的 gauge
+type gaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// newGaugeFunc 创建 gaugeFunc
+func newGaugeFunc(name, help string, value func() float64) *gaugeFunc {
+	return registerMetric(&gaugeFunc{name: name, help: help, value: value})
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// histogramVec 按标签值分别统计分布的直方图
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+// histogram 单组标签值的直方图数据，counts[i] 为不超过 buckets[i] 的观测数
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogramVec 创建直方图，buckets 为升序排列的上界
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return registerMetric(&histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}})
+}
+
+// observe 记录一次观测值
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	data := h.values[key]
+	if data == nil {
+		data = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = data
+	}
+	for i, upper := range h.buckets {
+		if v <= upper {
+			data.counts[i]++
+		}
+	}
+	data.count++
+	data.sum += v
+}
+
+// observeSince 记录从 start 开始经过的秒数
+func (h *histogramVec) observeSince(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedLabelKeys(h.values) {
+		data := h.values[key]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatFloat(upper)), data.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), data.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key), formatFloat(data.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key), data.count)
+	}
+}
+
+// 直方图的桶上界，单位为秒
+var (
+	latencyBuckets        = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	streamDurationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800}
+)
+
+var (
+	requestsTotal = newCounterVec(
+		"kiro2cc_requests_total",
+		"Number of HTTP requests handled by the proxy.",
+		"endpoint", "model", "status", "client",
+	)
+	requestsInFlight = newGaugeVec(
+		"kiro2cc_requests_in_flight",
+		"Number of HTTP requests currently being handled.",
+		"endpoint",
+	)
+	streamsInFlight = newGaugeFunc(
+		"kiro2cc_streams_in_flight",
+		"Number of streaming responses currently being sent to clients.",
+		func() float64 { return float64(activeStreams.count()) },
+	)
+	streamDurationSeconds = newHistogramVec(
+		"kiro2cc_stream_duration_seconds",
+		"Duration of streaming responses from request to the last event.",
+		streamDurationBuckets,
+		"model",
+	)
+	upstreamLatencySeconds = newHistogramVec(
+		"kiro2cc_upstream_latency_seconds",
+		"Time until CodeWhisperer returned response headers, per attempt.",
+		latencyBuckets,
+		"status",
+	)
+	upstreamTTFBSeconds = newHistogramVec(
+		"kiro2cc_upstream_ttfb_seconds",
+		"Time from sending the upstream request until the first response event.",
+		latencyBuckets,
+		"model",
+	)
+	upstreamRetriesTotal = newCounterVec(
+		"kiro2cc_upstream_retries_total",
+		"Number of upstream CodeWhisperer request retries.",
+		"reason",
+	)
+	rateLimitedTotal = newCounterVec(
+		"kiro2cc_rate_limited_total",
+		"Number of requests rejected by rate limits.",
+		"scope", "reason",
+	)
+	budgetExceededTotal = newCounterVec(
+		"kiro2cc_budget_exceeded_total",
+		"Number of requests rejected because a client key is over budget.",
+		"budget",
+	)
+	tokenRefreshesTotal = newCounterVec(
+		"kiro2cc_token_refreshes_total",
+		"Number of successful Kiro access token refreshes.",
+	)
+	tokenRefreshFailuresTotal = newCounterVec(
+		"kiro2cc_token_refresh_failures_total",
+		"Number of failed Kiro access token refreshes.",
+	)
+	inputTokensTotal = newCounterVec(
+		"kiro2cc_input_tokens_total",
+		"Estimated input tokens of completed requests.",
+		"model", "client",
+	)
+	outputTokensTotal = newCounterVec(
+		"kiro2cc_output_tokens_total",
+		"Estimated output tokens of completed requests.",
+		"model", "client",
+	)
+)
+
+// handleMetrics 以 Prometheus 文本格式输出所有指标
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, m := range metricsRegistry {
+		m.writeTo(w)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsTextFormat(t *testing.T) {
+	counter := &counterVec{name: "test_total", help: "Test counter.", labels: []string{"a"}, values: map[string]float64{}}
+	counter.inc(`x"y`)
+	counter.add(2, "b")
+
+	histogram := &histogramVec{name: "test_seconds", help: "Test histogram.", labels: []string{"m"}, buckets: []float64{0.5, 1}, values: map[string]*histogram{}}
+	histogram.observe(0.2, "m1")
+	histogram.observe(0.7, "m1")
+
+	var buf bytes.Buffer
+	counter.writeTo(&buf)
+	histogram.writeTo(&buf)
+
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="b"} 2
+test_total{a="x\"y"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{m="m1",le="0.5"} 1
+test_seconds_bucket{m="m1",le="1"} 2
+test_seconds_bucket{m="m1",le="+Inf"} 2
+test_seconds_sum{m="m1"} 0.8999999999999999
+test_seconds_count{m="m1"} 2
+`
+	if buf.String() != want {
+		t.Fatalf("metrics output:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestLabelValues(t *testing.T) {
+	// 只转义反斜杠、双引号和换行，%q 产生的 \x.. 和 \u.... 不是合法的 Prometheus 转义
+	if got, want := escapeLabelValue("a\\b\"c\nd\té模型"), `a\\b\"c\nd`+"\té模型"; got != want {
+		t.Fatalf("escapeLabelValue() = %q, want %q", got, want)
+	}
+	if got := formatLabels([]string{"a", "b"}, labelKey([]string{"x", `y"z`}), "le", "1"); got != `{a="x",b="y\"z",le="1"}` {
+		t.Fatalf("formatLabels() = %s", got)
+	}
+
+	for model, want := range map[string]string{
+		"claude-sonnet-4-20250514": "claude-sonnet-4-20250514",
+		"":                         "",
+		"my-random-model-123":      "other",
+	} {
+		if got := modelLabel(model); got != want {
+			t.Errorf("modelLabel(%q) = %q, want %q", model, got, want)
+		}
+	}
+
+	setBudgets(t, map[string]BudgetConfig{"team-key": {}, clientLabel("ops-key"): {}, "*": {}})
+	for key, want := range map[string]string{
+		"team-key":   clientLabel("team-key"),
+		"ops-key":    clientLabel("ops-key"),
+		"":           "anonymous",
+		"random-key": "other",
+	} {
+		if got := clientMetricLabel(key, clientLabel(key)); got != want {
+			t.Errorf("clientMetricLabel(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	setupFakeUpstream(t)
+	setBudgets(t, map[string]BudgetConfig{"team-key": {}})
+	handler := newServer("", defaultConfig().Server).Handler
+
+	req := messagesRequest(false)
+	req.Header.Set("x-api-key", "team-key")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	metrics := string(body)
+
+	client := clientLabel("team-key")
+	for _, want := range []string{
+		`kiro2cc_requests_total{endpoint="/v1/messages",model="claude-sonnet-4-20250514",status="200",client="` + client + `"}`,
+		`kiro2cc_input_tokens_total{model="claude-sonnet-4-20250514",client="` + client + `"}`,
+		`kiro2cc_upstream_latency_seconds_bucket{status="200",le="+Inf"}`,
+		`kiro2cc_upstream_ttfb_seconds_count{model="claude-sonnet-4-20250514"}`,
+		`kiro2cc_requests_in_flight{endpoint="/v1/messages"} 0`,
+		"kiro2cc_streams_in_flight 0",
+		"# TYPE kiro2cc_token_refresh_failures_total counter",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+	if strings.Contains(metrics, "team-key") {
+		t.Error("metrics contain the raw client key")
+	}
+}
+
+func TestTokenRefreshFailureCounted(t *testing.T) {
+	setupFakeUpstream(t)
+
+	refresh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer refresh.Close()
+	originalURL := refreshTokenURL
+	refreshTokenURL = refresh.URL
+	defer func() { refreshTokenURL = originalURL }()
+
+	failures := tokenRefreshFailuresTotal.value()
+	if _, err := refreshAccessToken(); err == nil {
+		t.Fatal("refresh succeeded against a failing endpoint")
+	}
+	if got := tokenRefreshFailuresTotal.value() - failures; got != 1 {
+		t.Fatalf("refresh failures = %v, want 1", got)
+	}
+}
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
-	"strings"
 )
 
 type assistantResponseEvent struct {
@@ -17,82 +17,247 @@ type assistantResponseEvent struct {
 	Stop      bool    `json:"stop"`
 }
 
+// reasoningContentEvent 表示模型输出的推理内容
+type reasoningContentEvent struct {
+	Text            string `json:"text"`
+	Signature       string `json:"signature"`
+	RedactedContent string `json:"redactedContent"`
+}
+
+// exceptionEvent 表示 CodeWhisperer 在事件流中返回的异常
+type exceptionEvent struct {
+	Message string `json:"message"`
+}
+
 type SSEEvent struct {
 	Event string      `json:"event"`
 	Data  interface{} `json:"data"`
 }
 
-func ParseEvents(resp []byte) []SSEEvent {
+// maxFrameLen 单个事件帧允许的最大长度
+const maxFrameLen = 16 << 20
 
-	events := []SSEEvent{}
+// ErrInvalidFrame 表示事件帧长度不合法
+var ErrInvalidFrame = errors.New("frame length invalid")
+
+// Decoder 从 io.Reader 中逐帧解析 CodeWhisperer 事件流，
+// 用于边读取上游响应边转发，不必等待整个响应结束
+type Decoder struct {
+	r       io.Reader
+	pending []SSEEvent // 一个帧可能转换出多个事件
+}
+
+// NewDecoder 创建事件流解析器
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r}
+}
 
-	r := bytes.NewReader(resp)
+// Next 返回下一个有效事件，流正常结束时返回 io.EOF
+func (d *Decoder) Next() (SSEEvent, error) {
 	for {
-		if r.Len() < 12 {
-			break
+		if len(d.pending) > 0 {
+			e := d.pending[0]
+			d.pending = d.pending[1:]
+			return e, nil
 		}
 
-		var totalLen, headerLen uint32
-		if err := binary.Read(r, binary.BigEndian, &totalLen); err != nil {
-			break
+		headers, payload, err := d.readFrame()
+		if err != nil {
+			return SSEEvent{}, err
 		}
-		if err := binary.Read(r, binary.BigEndian, &headerLen); err != nil {
-			break
+
+		if messageType := headers[":message-type"]; messageType == "exception" || messageType == "error" {
+			return convertExceptionToSSE(headers, payload), nil
 		}
 
-		if int(totalLen) > r.Len()+8 {
-			log.Println("Frame length invalid")
-			break
+		if headers[":event-type"] == "reasoningContentEvent" {
+			var evt reasoningContentEvent
+			if err := json.Unmarshal(payload, &evt); err != nil {
+				log.Println("json unmarshal error:", err)
+				continue
+			}
+			d.pending = convertReasoningEventToSSE(evt)
+			continue
 		}
 
-		// Skip header
-		header := make([]byte, headerLen)
-		if _, err := io.ReadFull(r, header); err != nil {
-			break
+		var evt assistantResponseEvent
+		if err := json.Unmarshal(payload, &evt); err != nil {
+			log.Println("json unmarshal error:", err)
+			continue
+		}
+		if sse := convertAssistantEventToSSE(evt); sse.Event != "" {
+			return sse, nil
 		}
+	}
+}
 
-		payloadLen := int(totalLen) - int(headerLen) - 12
-		payload := make([]byte, payloadLen)
-		if _, err := io.ReadFull(r, payload); err != nil {
-			break
+// readFrame 读取一个完整的事件帧，返回帧头和负载
+func (d *Decoder) readFrame() (map[string]string, []byte, error) {
+	prelude := make([]byte, 12)
+	if _, err := io.ReadFull(d.r, prelude); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, nil, io.EOF
+		}
+		return nil, nil, err
+	}
+
+	totalLen := binary.BigEndian.Uint32(prelude[0:4])
+	headerLen := binary.BigEndian.Uint32(prelude[4:8])
+	// prelude[8:12] 为 prelude CRC32
+
+	if totalLen > maxFrameLen || int(totalLen) < int(headerLen)+16 {
+		return nil, nil, ErrInvalidFrame
+	}
+
+	// 帧剩余部分：帧头 + 负载 + CRC32
+	rest := make([]byte, int(totalLen)-12)
+	if _, err := io.ReadFull(d.r, rest); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, nil, ErrInvalidFrame
 		}
+		return nil, nil, err
+	}
 
-		// Skip CRC32
-		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+	headers := parseHeaders(rest[:headerLen])
+	payload := rest[headerLen : len(rest)-4]
+	return headers, payload, nil
+}
+
+func ParseEvents(resp []byte) []SSEEvent {
+
+	events := []SSEEvent{}
+
+	d := NewDecoder(bytes.NewReader(resp))
+	for {
+		e, err := d.Next()
+		if err != nil {
+			if err != io.EOF {
+				log.Println(err)
+			}
 			break
 		}
+		events = append(events, e)
+	}
 
-		payloadStr := strings.TrimPrefix(string(payload), "vent")
+	return events
+}
 
-		var evt assistantResponseEvent
-		if err := json.Unmarshal([]byte(payloadStr), &evt); err == nil {
-
-			events = append(events, convertAssistantEventToSSE(evt))
-
-			if evt.ToolUseId != "" && evt.Name != "" {
-				if evt.Stop {
-					events = append(events, SSEEvent{
-						Event: "message_delta",
-						Data: map[string]interface{}{
-							"type": "message_delta",
-							"delta": map[string]interface{}{
-								"stop_reason":   "tool_use",
-								"stop_sequence": nil,
-							},
-							"usage": map[string]interface{}{"output_tokens": 0},
-						},
-					})
-				}
+// parseHeaders 解析 AWS event stream 帧头，只保留字符串类型的值
+func parseHeaders(header []byte) map[string]string {
+	headers := map[string]string{}
+
+	for i := 0; i < len(header); {
+		nameLen := int(header[i])
+		i++
+		if i+nameLen+1 > len(header) {
+			break
+		}
+		name := string(header[i : i+nameLen])
+		i += nameLen
 
+		valueType := header[i]
+		i++
+
+		var valueLen int
+		switch valueType {
+		case 0, 1: // bool
+			valueLen = 0
+		case 2: // byte
+			valueLen = 1
+		case 3: // short
+			valueLen = 2
+		case 4: // int
+			valueLen = 4
+		case 5, 8: // long, timestamp
+			valueLen = 8
+		case 9: // uuid
+			valueLen = 16
+		case 6, 7: // bytes, string
+			if i+2 > len(header) {
+				return headers
 			}
-		} else {
-			log.Println("json unmarshal error:", err)
+			valueLen = int(binary.BigEndian.Uint16(header[i : i+2]))
+			i += 2
+		default:
+			return headers
+		}
+
+		if i+valueLen > len(header) {
+			break
+		}
+		if valueType == 7 {
+			headers[name] = string(header[i : i+valueLen])
 		}
+		i += valueLen
+	}
+
+	return headers
+}
+
+func convertReasoningEventToSSE(evt reasoningContentEvent) []SSEEvent {
+	var events []SSEEvent
+
+	if evt.RedactedContent != "" {
+		events = append(events, SSEEvent{
+			Event: "content_block_start",
+			Data: map[string]interface{}{
+				"type": "content_block_start",
+				"content_block": map[string]interface{}{
+					"type": "redacted_thinking",
+					"data": evt.RedactedContent,
+				},
+			},
+		})
+	}
+	if evt.Text != "" {
+		events = append(events, SSEEvent{
+			Event: "content_block_delta",
+			Data: map[string]interface{}{
+				"type": "content_block_delta",
+				"delta": map[string]interface{}{
+					"type":     "thinking_delta",
+					"thinking": evt.Text,
+				},
+			},
+		})
+	}
+	if evt.Signature != "" {
+		events = append(events, SSEEvent{
+			Event: "content_block_delta",
+			Data: map[string]interface{}{
+				"type": "content_block_delta",
+				"delta": map[string]interface{}{
+					"type":      "signature_delta",
+					"signature": evt.Signature,
+				},
+			},
+		})
 	}
 
 	return events
 }
 
+func convertExceptionToSSE(headers map[string]string, payload []byte) SSEEvent {
+	var evt exceptionEvent
+	if err := json.Unmarshal(payload, &evt); err != nil {
+		evt.Message = string(payload)
+	}
+
+	exceptionType := headers[":exception-type"]
+	if exceptionType == "" {
+		exceptionType = headers[":error-code"]
+	}
+
+	return SSEEvent{
+		Event: "exception",
+		Data: map[string]interface{}{
+			"type":           "exception",
+			"exception_type": exceptionType,
+			"message":        evt.Message,
+		},
+	}
+}
+
 func convertAssistantEventToSSE(evt assistantResponseEvent) SSEEvent {
 	if evt.Content != "" {
 		return SSEEvent{
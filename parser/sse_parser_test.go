@@ -1,8 +1,11 @@
 package parser
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"os"
 	"testing"
 )
@@ -22,3 +25,88 @@ func TestParseCodeWhispererEvents(t *testing.T) {
 		fmt.Printf("data: %s\n\n", string(json))
 	}
 }
+
+func TestParseEventsNoInjectedMessageDelta(t *testing.T) {
+	data, err := os.ReadFile("response.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, e := range ParseEvents(data) {
+		if e.Event == "message_delta" {
+			t.Fatalf("parser should not emit message_delta, got %v", e.Data)
+		}
+		got = append(got, e.Event)
+	}
+
+	want := []string{
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_start",
+		"content_block_delta",
+		"content_block_delta",
+		"content_block_stop",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+}
+
+func TestParseEventsException(t *testing.T) {
+	data := buildFrame(map[string]string{
+		":message-type":   "exception",
+		":exception-type": "ContentLengthExceededException",
+	}, `{"message":"Output too long"}`)
+
+	events := ParseEvents(data)
+	if len(events) != 1 || events[0].Event != "exception" {
+		t.Fatalf("events = %v, want single exception", events)
+	}
+	m := events[0].Data.(map[string]interface{})
+	if m["exception_type"] != "ContentLengthExceededException" || m["message"] != "Output too long" {
+		t.Fatalf("unexpected exception data: %v", m)
+	}
+}
+
+func TestParseEventsReasoning(t *testing.T) {
+	headers := map[string]string{":message-type": "event", ":event-type": "reasoningContentEvent"}
+	var data []byte
+	data = append(data, buildFrame(headers, `{"text":"Let me think"}`)...)
+	data = append(data, buildFrame(headers, `{"signature":"sig123"}`)...)
+
+	events := ParseEvents(data)
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+
+	thinking := events[0].Data.(map[string]interface{})["delta"].(map[string]interface{})
+	if thinking["type"] != "thinking_delta" || thinking["thinking"] != "Let me think" {
+		t.Fatalf("unexpected thinking delta: %v", thinking)
+	}
+	signature := events[1].Data.(map[string]interface{})["delta"].(map[string]interface{})
+	if signature["type"] != "signature_delta" || signature["signature"] != "sig123" {
+		t.Fatalf("unexpected signature delta: %v", signature)
+	}
+}
+
+// buildFrame 构造一个 AWS event stream 帧
+func buildFrame(headers map[string]string, payload string) []byte {
+	var h bytes.Buffer
+	for name, value := range headers {
+		h.WriteByte(byte(len(name)))
+		h.WriteString(name)
+		h.WriteByte(7)
+		binary.Write(&h, binary.BigEndian, uint16(len(value)))
+		h.WriteString(value)
+	}
+
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint32(12+h.Len()+len(payload)+4))
+	binary.Write(&b, binary.BigEndian, uint32(h.Len()))
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(b.Bytes()))
+	b.Write(h.Bytes())
+	b.WriteString(payload)
+	binary.Write(&b, binary.BigEndian, crc32.ChecksumIEEE(b.Bytes()))
+	return b.Bytes()
+}
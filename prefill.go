@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// splitPrefill 拆分出末尾的 assistant 预填充消息。
+// Anthropic 允许最后一条消息为 assistant，模型的回复需要接着这段前缀继续输出。
+// 末尾的 assistant 消息没有文本（只有 tool_use 或 thinking 块）时不是预填充，保留在历史中
+func splitPrefill(messages []AnthropicRequestMessage) ([]AnthropicRequestMessage, string) {
+	if len(messages) == 0 || messages[len(messages)-1].Role != "assistant" {
+		return messages, ""
+	}
+
+	prefill := strings.TrimRight(prefillText(messages[len(messages)-1].Content), " \t\r\n")
+	if prefill == "" {
+		return messages, ""
+	}
+	return messages[:len(messages)-1], prefill
+}
+
+// assistantPrefill 返回请求中的 assistant 预填充内容，没有时返回空字符串
+func assistantPrefill(anthropicReq AnthropicRequest) string {
+	_, prefill := splitPrefill(anthropicReq.Messages)
+	return prefill
+}
+
+// prefillText 提取预填充消息中的文本，不使用 getMessageContent 以免空内容被替换为占位文本
+func prefillText(content any) string {
+	switch v := content.(type) {
+	case string:
+		return v
+	case []any:
+		var texts []string
+		for _, block := range v {
+			if m, ok := block.(map[string]any); ok && m["type"] == "text" {
+				if text, ok := m["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			}
+		}
+		return strings.Join(texts, "")
+	}
+	return ""
+}
+
+// prefillInstruction 返回让上游模型接着前缀继续输出的指令，CodeWhisperer 不支持 assistant 预填充
+func prefillInstruction(prefill string) string {
+	return fmt.Sprintf("Your response has already been started with the text between <prefix> tags. "+
+		"Continue it exactly from where it ends. Output only the continuation and do not repeat the prefix.\n"+
+		"<prefix>%s</prefix>", prefill)
+}
+
+// prefillStitcher 处理模型回复的开头，模型重复输出了前缀时将其去掉，保证返回内容是前缀的延续
+type prefillStitcher struct {
+	prefix string
+	buf    string
+	done   bool
+}
+
+// write 传入一段回复文本，返回可以输出的部分
+func (s *prefillStitcher) write(text string) string {
+	if s.done {
+		return text
+	}
+
+	s.buf += text
+	trimmed := strings.TrimLeft(s.buf, " \t\r\n")
+	switch {
+	case strings.HasPrefix(trimmed, s.prefix):
+		s.done = true
+		return strings.TrimPrefix(trimmed, s.prefix)
+	case strings.HasPrefix(s.prefix, trimmed):
+		// 还不能确定是否在重复前缀，继续等待
+		return ""
+	default:
+		s.done = true
+		return s.buf
+	}
+}
+
+// flush 返回仍在等待判断的文本
+func (s *prefillStitcher) flush() string {
+	if s.done {
+		return ""
+	}
+	s.done = true
+	return s.buf
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bestk/kiro2cc/parser"
+)
+
+func TestPrefillStitcher(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		chunks []string
+		want   string
+	}{
+		{name: "continuation only", prefix: "{", chunks: []string{`"a": 1}`}, want: `"a": 1}`},
+		{name: "repeated prefix", prefix: "{", chunks: []string{`{"a": 1}`}, want: `"a": 1}`},
+		{name: "repeated prefix split across deltas", prefix: `{"name":`, chunks: []string{`{"na`, `me": "x"}`}, want: ` "x"}`},
+		{name: "leading whitespace before repeat", prefix: "Answer:", chunks: []string{"\nAnswer: 42"}, want: " 42"},
+		{name: "partial prefix then divergence", prefix: "Answer:", chunks: []string{"Ans", "wer is 42"}, want: "Answer is 42"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &prefillStitcher{prefix: tt.prefix}
+			var got strings.Builder
+			for _, chunk := range tt.chunks {
+				got.WriteString(s.write(chunk))
+			}
+			got.WriteString(s.flush())
+			if got.String() != tt.want {
+				t.Fatalf("got %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefillRequest(t *testing.T) {
+	req := AnthropicRequest{
+		Model: "claude-sonnet-4-20250514",
+		Messages: []AnthropicRequestMessage{
+			{Role: "user", Content: "Give me JSON"},
+			{Role: "assistant", Content: "{"},
+		},
+	}
+
+	cwReq := buildCodeWhispererRequest(req)
+	content := cwReq.ConversationState.CurrentMessage.UserInputMessage.Content
+	if !strings.HasPrefix(content, "Give me JSON") || !strings.Contains(content, "<prefix>{</prefix>") {
+		t.Fatalf("unexpected current message: %q", content)
+	}
+	if len(cwReq.ConversationState.History) != 0 {
+		t.Fatalf("prefill must not be sent as history: %v", cwReq.ConversationState.History)
+	}
+
+	_, blocks := translate(req, []parser.SSEEvent{textEvent(`{"ok": true}`)})
+	if len(blocks) != 1 || blocks[0]["text"] != `"ok": true}` {
+		t.Fatalf("unexpected blocks: %v", blocks)
+	}
+}
+
+func TestTrailingAssistantWithoutTextIsKept(t *testing.T) {
+	toolUse := []any{map[string]any{"type": "tool_use", "id": "toolu_1", "name": "Read", "input": map[string]any{"file_path": "a.go"}}}
+	messages := []AnthropicRequestMessage{
+		{Role: "user", Content: "read a.go"},
+		{Role: "assistant", Content: toolUse},
+	}
+
+	kept, prefill := splitPrefill(messages)
+	if prefill != "" || len(kept) != 2 {
+		t.Fatalf("splitPrefill() = %d messages, prefill %q; want the assistant message kept", len(kept), prefill)
+	}
+
+	cwReq := buildCodeWhispererRequest(AnthropicRequest{Model: "claude-sonnet-4-20250514", Messages: messages})
+	if len(cwReq.ConversationState.History) != 2 {
+		t.Fatalf("history = %v, want the tool_use turn kept", cwReq.ConversationState.History)
+	}
+	if content := cwReq.ConversationState.CurrentMessage.UserInputMessage.Content; strings.Contains(content, "<prefix>") {
+		t.Fatalf("unexpected prefill instruction: %q", content)
+	}
+}
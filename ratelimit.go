@@ -0,0 +1,269 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tokenBucket 令牌桶，容量为每分钟的限额，按限额匀速补充。
+// 允许欠账：请求结束后补扣的输出 token 可以让余额变为负数，之后的请求需要等待余额恢复
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	rate     float64 // 每秒补充的数量
+	updated  time.Time
+}
+
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &tokenBucket{
+		capacity: float64(perMinute),
+		tokens:   float64(perMinute),
+		rate:     float64(perMinute) / 60,
+		updated:  now,
+	}
+}
+
+// refill 按经过的时间补充令牌
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.capacity, b.tokens+elapsed*b.rate)
+		b.updated = now
+	}
+}
+
+// wait 返回余额足够支付 cost 前需要等待的时间，cost 超过容量时只要求桶是满的
+func (b *tokenBucket) wait(cost float64) time.Duration {
+	need := math.Min(cost, b.capacity) - b.tokens
+	if need <= 0 {
+		return 0
+	}
+	return time.Duration(need / b.rate * float64(time.Second))
+}
+
+// resetAfter 返回桶恢复满额需要的时间
+func (b *tokenBucket) resetAfter() time.Duration {
+	return time.Duration((b.capacity - b.tokens) / b.rate * float64(time.Second))
+}
+
+// limiterState 一个限流范围（单个客户端或全局）的状态
+type limiterState struct {
+	scope      string
+	limits     LimitConfig
+	requests   *tokenBucket
+	tokens     *tokenBucket
+	concurrent int
+}
+
+func newLimiterState(scope string, limits LimitConfig, now time.Time) *limiterState {
+	return &limiterState{
+		scope:    scope,
+		limits:   limits,
+		requests: newTokenBucket(limits.RequestsPerMinute, now),
+		tokens:   newTokenBucket(limits.TokensPerMinute, now),
+	}
+}
+
+// idle 返回该范围是否处于空闲状态：没有进行中的请求，令牌桶已补满。
+// 空闲状态与新建的状态等价，可以丢弃
+func (s *limiterState) idle(now time.Time) bool {
+	if s.concurrent > 0 {
+		return false
+	}
+	for _, b := range []*tokenBucket{s.requests, s.tokens} {
+		if b == nil {
+			continue
+		}
+		b.refill(now)
+		if b.tokens < b.capacity {
+			return false
+		}
+	}
+	return true
+}
+
+// limiterSweepInterval 清理空闲客户端限流状态的间隔
+const limiterSweepInterval = time.Minute
+
+// rateLimiter 按客户端和全局两个范围限制请求频率、估算 token 速率和并发请求数
+type rateLimiter struct {
+	mu        sync.Mutex
+	cfg       RateLimitConfig
+	global    *limiterState
+	clients   map[string]*limiterState
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func newRateLimiter(cfg RateLimitConfig) *rateLimiter {
+	l := &rateLimiter{cfg: cfg, clients: map[string]*limiterState{}, now: time.Now}
+	l.global = newLimiterState("global", cfg.Global, l.now())
+	return l
+}
+
+// currentRateLimiter 当前生效的限流器，配置变更时重新创建
+var currentRateLimiter atomic.Pointer[rateLimiter]
+
+// activeRateLimiter 返回当前的限流器，尚未创建时按当前配置创建
+func activeRateLimiter() *rateLimiter {
+	if l := currentRateLimiter.Load(); l != nil {
+		return l
+	}
+	currentRateLimiter.CompareAndSwap(nil, newRateLimiter(config().RateLimit))
+	return currentRateLimiter.Load()
+}
+
+// rateLimitStatus 返回给客户端的限额信息，取各范围中剩余最少的一个
+type rateLimitStatus struct {
+	requests *tokenBucket
+	tokens   *tokenBucket
+	now      time.Time
+}
+
+// rateLimitError 请求超出限额时返回的错误
+type rateLimitError struct {
+	*anthropicError
+	RetryAfter time.Duration
+}
+
+// acquire 检查并占用客户端和全局范围的限额，cost 为估算的输入 token 数。
+// 成功时返回请求结束后调用的 release，用于释放并发数并补扣输出 token
+func (l *rateLimiter) acquire(client string, cost int) (release func(outputTokens int), status rateLimitStatus, limitErr *rateLimitError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	state := l.clients[client]
+	if state == nil {
+		state = newLimiterState(client, l.cfg.PerClient, now)
+		l.clients[client] = state
+	}
+	states := []*limiterState{state, l.global}
+
+	for _, s := range states {
+		for _, b := range []*tokenBucket{s.requests, s.tokens} {
+			if b != nil {
+				b.refill(now)
+			}
+		}
+	}
+	status = l.status(states, now)
+
+	for _, s := range states {
+		if s.limits.MaxConcurrent > 0 && s.concurrent >= s.limits.MaxConcurrent {
+			return nil, status, l.reject(s, "concurrent requests", s.limits.MaxConcurrent, time.Second)
+		}
+		if s.requests != nil {
+			if wait := s.requests.wait(1); wait > 0 {
+				return nil, status, l.reject(s, "requests per minute", s.limits.RequestsPerMinute, wait)
+			}
+		}
+		if s.tokens != nil {
+			if wait := s.tokens.wait(float64(cost)); wait > 0 {
+				return nil, status, l.reject(s, "tokens per minute", s.limits.TokensPerMinute, wait)
+			}
+		}
+	}
+
+	for _, s := range states {
+		s.concurrent++
+		if s.requests != nil {
+			s.requests.tokens--
+		}
+		if s.tokens != nil {
+			s.tokens.tokens -= float64(cost)
+		}
+	}
+	status = l.status(states, now)
+
+	var once sync.Once
+	release = func(outputTokens int) {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for _, s := range states {
+				s.concurrent--
+				if s.tokens != nil {
+					s.tokens.tokens -= float64(outputTokens)
+				}
+			}
+		})
+	}
+	return release, status, nil
+}
+
+// sweep 每隔 limiterSweepInterval 丢弃空闲的客户端限流状态，避免客户端 key 很多时占用的内存不断增长，
+// 调用方需持有 mu
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < limiterSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for client, state := range l.clients {
+		if state.idle(now) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// reject 生成超出限额的错误并记录指标
+func (l *rateLimiter) reject(s *limiterState, reason string, limit int, wait time.Duration) *rateLimitError {
+	rateLimitedTotal.inc(limitScope(s), reason)
+	return &rateLimitError{
+		anthropicError: newAnthropicError(http.StatusTooManyRequests,
+			"Rate limit exceeded for %s: %s (limit %d), please retry after %v", s.scope, reason, limit, wait.Round(time.Second)),
+		RetryAfter: wait,
+	}
+}
+
+// limitScope 返回指标中使用的范围名
+func limitScope(s *limiterState) string {
+	if s.scope == "global" {
+		return "global"
+	}
+	return "client"
+}
+
+// status 返回各范围中剩余最少的请求数和 token 数限额
+func (l *rateLimiter) status(states []*limiterState, now time.Time) rateLimitStatus {
+	status := rateLimitStatus{now: now}
+	for _, s := range states {
+		if s.requests != nil && (status.requests == nil || s.requests.tokens < status.requests.tokens) {
+			copied := *s.requests
+			status.requests = &copied
+		}
+		if s.tokens != nil && (status.tokens == nil || s.tokens.tokens < status.tokens.tokens) {
+			copied := *s.tokens
+			status.tokens = &copied
+		}
+	}
+	return status
+}
+
+// writeHeaders 写出 anthropic-ratelimit-* 响应头
+func (s rateLimitStatus) writeHeaders(h http.Header) {
+	write := func(prefix string, b *tokenBucket) {
+		if b == nil {
+			return
+		}
+		h.Set(prefix+"-limit", strconv.Itoa(int(b.capacity)))
+		h.Set(prefix+"-remaining", strconv.Itoa(max(0, int(b.tokens))))
+		h.Set(prefix+"-reset", s.now.Add(b.resetAfter()).UTC().Format(time.RFC3339))
+	}
+	write("anthropic-ratelimit-requests", s.requests)
+	write("anthropic-ratelimit-tokens", s.tokens)
+}
+
+// writeRateLimitError 返回 429 错误以及 retry-after 响应头
+func writeRateLimitError(w http.ResponseWriter, limitErr *rateLimitError) {
+	seconds := int(math.Ceil(limitErr.RetryAfter.Seconds()))
+	w.Header().Set("retry-after", strconv.Itoa(max(1, seconds)))
+	writeAnthropicError(w, limitErr.anthropicError)
+}
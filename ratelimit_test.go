@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClockLimiter 创建使用可控时钟的限流器
+func fakeClockLimiter(cfg RateLimitConfig) (*rateLimiter, *time.Time) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(cfg)
+	l.now = func() time.Time { return now }
+	l.global = newLimiterState("global", cfg.Global, now)
+	return l, &now
+}
+
+func TestRateLimiterRequestsPerMinute(t *testing.T) {
+	l, now := fakeClockLimiter(RateLimitConfig{PerClient: LimitConfig{RequestsPerMinute: 2}})
+
+	for i := 0; i < 2; i++ {
+		release, _, err := l.acquire("a", 10)
+		if err != nil {
+			t.Fatalf("request %d rejected: %v", i, err)
+		}
+		release(0)
+	}
+
+	_, status, err := l.acquire("a", 10)
+	if err == nil || err.Status != http.StatusTooManyRequests || err.Type != "rate_limit_error" {
+		t.Fatalf("third request err = %v, want rate_limit_error", err)
+	}
+	if err.RetryAfter != 30*time.Second {
+		t.Fatalf("RetryAfter = %v, want 30s", err.RetryAfter)
+	}
+	if status.requests.tokens >= 1 {
+		t.Fatalf("remaining = %v, want < 1", status.requests.tokens)
+	}
+
+	// 其他客户端不受影响
+	if _, _, err := l.acquire("b", 10); err != nil {
+		t.Fatalf("other client rejected: %v", err)
+	}
+
+	*now = now.Add(30 * time.Second)
+	if _, _, err := l.acquire("a", 10); err != nil {
+		t.Fatalf("request after refill rejected: %v", err)
+	}
+}
+
+func TestRateLimiterEvictsIdleClients(t *testing.T) {
+	l, now := fakeClockLimiter(RateLimitConfig{PerClient: LimitConfig{RequestsPerMinute: 60, MaxConcurrent: 2}})
+
+	for _, client := range []string{"a", "b", "c"} {
+		release, _, err := l.acquire(client, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release(0)
+	}
+	busy, _, err := l.acquire("busy", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 令牌桶补满后，没有进行中请求的客户端在下一次清理时被丢弃
+	*now = now.Add(limiterSweepInterval)
+	if _, _, err := l.acquire("d", 10); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.clients) != 2 || l.clients["busy"] == nil || l.clients["d"] == nil {
+		t.Fatalf("clients after sweep = %v, want busy and d", l.clients)
+	}
+
+	// 被丢弃的客户端重新按满额开始
+	busy(0)
+	if _, _, err := l.acquire("a", 10); err != nil {
+		t.Fatalf("evicted client rejected: %v", err)
+	}
+}
+
+func TestRateLimiterTokensAndConcurrency(t *testing.T) {
+	l, now := fakeClockLimiter(RateLimitConfig{
+		PerClient: LimitConfig{TokensPerMinute: 600},
+		Global:    LimitConfig{MaxConcurrent: 1},
+	})
+
+	release, _, err := l.acquire("a", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := l.acquire("b", 100); err == nil {
+		t.Fatal("second concurrent request accepted over the global limit")
+	}
+
+	// 结束时补扣输出 token，余额变为负数
+	release(700)
+	_, _, err = l.acquire("a", 100)
+	if err == nil {
+		t.Fatal("request accepted while the token bucket is in debt")
+	}
+	if err.RetryAfter != 30*time.Second {
+		t.Fatalf("RetryAfter = %v, want 30s to recover 300 tokens at 10/s", err.RetryAfter)
+	}
+
+	*now = now.Add(30 * time.Second)
+	if _, _, err := l.acquire("a", 100); err != nil {
+		t.Fatalf("request after refill rejected: %v", err)
+	}
+}
+
+func TestHandleMessagesRateLimited(t *testing.T) {
+	setupFakeUpstream(t)
+	previous := currentRateLimiter.Swap(newRateLimiter(RateLimitConfig{PerClient: LimitConfig{RequestsPerMinute: 1}}))
+	defer currentRateLimiter.Store(previous)
+
+	rec := httptest.NewRecorder()
+	handleMessages(rec, messagesRequest(false))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("first request status = %d", rec.Code)
+	}
+	if got := rec.Header().Get("anthropic-ratelimit-requests-limit"); got != "1" {
+		t.Fatalf("anthropic-ratelimit-requests-limit = %q, want 1", got)
+	}
+	if got := rec.Header().Get("anthropic-ratelimit-requests-remaining"); got != "0" {
+		t.Fatalf("anthropic-ratelimit-requests-remaining = %q, want 0", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handleMessages(rec, messagesRequest(true))
+	checkErrorResponse(t, rec, http.StatusTooManyRequests, "rate_limit_error")
+	if got := rec.Header().Get("retry-after"); got != "60" {
+		t.Fatalf("retry-after = %q, want 60", got)
+	}
+	if rec.Header().Get("anthropic-ratelimit-requests-reset") == "" {
+		t.Fatal("missing anthropic-ratelimit-requests-reset")
+	}
+}
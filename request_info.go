@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// requestInfo 请求处理过程中记录的信息，处理结束后由 logMiddleware 汇总到日志和指标中
+type requestInfo struct {
+	Client       string // 客户端标识，见 clientLabel
+	Model        string
+	Account      string // 处理请求的上游账号
+	InputTokens  int
+	OutputTokens int
+	StopReason   string // 请求成功完成时的 stop_reason
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo 返回携带 info 的 context
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// requestInfoFrom 返回 context 中的请求信息，没有时返回一个不会被汇总的空记录
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// ensureRequestInfo 返回请求中的 requestInfo，请求没有经过 logMiddleware 时创建一个并附加到请求上
+func ensureRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return r, info
+	}
+	info := &requestInfo{Client: clientLabel(clientKey(r))}
+	return r.WithContext(withRequestInfo(r.Context(), info)), info
+}
+
+// clientKey 返回请求携带的客户端 key，来自 x-api-key 或 Authorization: Bearer
+func clientKey(r *http.Request) string {
+	if key := r.Header.Get("x-api-key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return ""
+}
+
+// clientLabel 返回用于日志和指标的客户端标识，不包含 key 原文
+func clientLabel(key string) string {
+	if key == "" {
+		return "anonymous"
+	}
+	return "key-" + shortHash(key)
+}
+
+// statusRecorder 记录响应状态码，同时保留 http.Flusher 以支持流式响应
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusRecorder) Flush() {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
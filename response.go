@@ -0,0 +1,537 @@
+package main
+
+import (
+	jsonStr "encoding/json"
+	"log"
+	"strings"
+
+	"github.com/bestk/kiro2cc/parser"
+)
+
+// Anthropic stop_reason 取值
+const (
+	stopReasonEndTurn      = "end_turn"
+	stopReasonToolUse      = "tool_use"
+	stopReasonMaxTokens    = "max_tokens"
+	stopReasonStopSequence = "stop_sequence"
+)
+
+// responseTranslator 将解析出的 CodeWhisperer 事件转换为 Anthropic 内容块事件，
+// 负责分配内容块索引并判定最终的 stop_reason，流式和非流式请求共用
+type responseTranslator struct {
+	emit func(eventType string, data any)
+
+	nextIndex  int
+	openIndex  int
+	openType   string // 当前打开的内容块类型，空字符串表示没有打开的块
+	openToolId string
+	openTool   struct {
+		name  string
+		input strings.Builder
+	}
+
+	thinking      bool              // 请求启用了 extended thinking，输出推理内容
+	prefill       *prefillStitcher  // 请求带有 assistant 预填充时用于拼接回复
+	toolNames     map[string]string // 改写后的工具名到原始工具名的映射
+	toolSchemas   map[string]map[string]any
+	stopSequences []string
+	maxChars      int    // 输出字符预算，0 表示不限制
+	outputChars   int    // 已输出的字符数
+	heldText      string // 可能是 stop sequence 前缀而暂缓输出的文本
+	done          bool   // 已命中 stop sequence 或 max_tokens，忽略后续事件
+
+	hasToolUse   bool
+	stopReason   string
+	stopSequence *string
+	exception    string // CodeWhisperer 在事件流中返回的异常信息
+	err          error  // 无法修复的工具参数等导致响应不可用的错误
+}
+
+// newResponseTranslator 创建转换器，emit 用于输出转换后的事件。
+// CodeWhisperer 不支持 stop_sequences 和 max_tokens，由转换器在本地执行
+func newResponseTranslator(anthropicReq AnthropicRequest, emit func(eventType string, data any)) *responseTranslator {
+	t := &responseTranslator{emit: emit, thinking: thinkingEnabled(anthropicReq)}
+	_, t.toolNames = toolNameMapping(anthropicReq.Tools)
+	t.toolSchemas = map[string]map[string]any{}
+	for _, tool := range anthropicReq.Tools {
+		t.toolSchemas[tool.Name] = tool.InputSchema
+	}
+	if prefill := assistantPrefill(anthropicReq); prefill != "" {
+		t.prefill = &prefillStitcher{prefix: prefill}
+	}
+	for _, seq := range anthropicReq.StopSequences {
+		if seq != "" {
+			t.stopSequences = append(t.stopSequences, seq)
+		}
+	}
+	if anthropicReq.MaxTokens > 0 {
+		t.maxChars = anthropicReq.MaxTokens * charsPerToken
+	}
+	return t
+}
+
+// stopped 返回是否已经提前结束，调用方应停止读取上游响应
+func (t *responseTranslator) stopped() bool {
+	return t.done
+}
+
+// outputTokens 返回估算的输出 token 数
+func (t *responseTranslator) outputTokens() int {
+	return (t.outputChars + charsPerToken - 1) / charsPerToken
+}
+
+// handle 处理一个解析出的 CodeWhisperer 事件
+func (t *responseTranslator) handle(e parser.SSEEvent) {
+	dataMap, ok := e.Data.(map[string]any)
+	if !ok || t.done {
+		return
+	}
+
+	switch e.Event {
+	case "content_block_delta":
+		delta, _ := dataMap["delta"].(map[string]any)
+		switch delta["type"] {
+		case "text_delta":
+			text, _ := delta["text"].(string)
+			t.text(text)
+		case "input_json_delta":
+			id, _ := delta["id"].(string)
+			name, _ := delta["name"].(string)
+			t.startToolUse(id, name)
+			if t.openType != "tool_use" {
+				return
+			}
+			t.inputJson(partialJsonString(delta["partial_json"]))
+		case "thinking_delta":
+			thinking, _ := delta["thinking"].(string)
+			t.thinkingText(thinking)
+		case "signature_delta":
+			signature, _ := delta["signature"].(string)
+			t.signature(signature)
+		}
+	case "content_block_start":
+		block, _ := dataMap["content_block"].(map[string]any)
+		switch block["type"] {
+		case "tool_use":
+			id, _ := block["id"].(string)
+			name, _ := block["name"].(string)
+			t.startToolUse(id, name)
+		case "redacted_thinking":
+			data, _ := block["data"].(string)
+			t.redactedThinking(data)
+		}
+	case "content_block_stop":
+		if t.openType == "tool_use" {
+			t.closeBlock()
+		}
+	case "exception":
+		t.exception = exceptionMessage(dataMap)
+		if strings.Contains(t.exception, "ContentLengthExceeded") {
+			t.stopReason = stopReasonMaxTokens
+		}
+		log.Printf("CodeWhisperer exception: %s", t.exception)
+	}
+}
+
+// exceptionMessage 返回 exception 事件的异常类型和信息
+func exceptionMessage(dataMap map[string]any) string {
+	exceptionType, _ := dataMap["exception_type"].(string)
+	message, _ := dataMap["message"].(string)
+	return exceptionType + ": " + message
+}
+
+// text 处理一段文本，检查 stop sequence 后输出
+func (t *responseTranslator) text(text string) {
+	if t.prefill != nil {
+		text = t.prefill.write(text)
+	}
+	if text == "" {
+		return
+	}
+
+	pending := t.heldText + text
+	t.heldText = ""
+
+	if i, seq := findStopSequence(pending, t.stopSequences); i >= 0 {
+		t.writeText(pending[:i])
+		if !t.done {
+			t.stop(stopReasonStopSequence, &seq)
+		}
+		return
+	}
+
+	// stop sequence 可能被拆分在多个 delta 中，暂缓输出可能匹配的尾部
+	keep := stopSequencePrefixLen(pending, t.stopSequences)
+	t.heldText = pending[len(pending)-keep:]
+	t.writeText(pending[:len(pending)-keep])
+}
+
+// flushText 输出暂缓的文本
+func (t *responseTranslator) flushText() {
+	if t.prefill != nil {
+		t.text(t.prefill.flush())
+		if t.done {
+			return
+		}
+	}
+
+	held := t.heldText
+	t.heldText = ""
+	t.writeText(held)
+}
+
+// writeText 在输出预算内输出文本，必要时打开新的 text 块
+func (t *responseTranslator) writeText(text string) {
+	text, truncated := t.takeBudget(text)
+	if text != "" {
+		if t.openType != "text" {
+			t.closeBlock()
+			t.openBlock("text", map[string]any{"type": "text", "text": ""})
+		}
+
+		t.emit("content_block_delta", map[string]any{
+			"type":  "content_block_delta",
+			"index": t.openIndex,
+			"delta": map[string]any{
+				"type": "text_delta",
+				"text": text,
+			},
+		})
+	}
+	if truncated {
+		t.stop(stopReasonMaxTokens, nil)
+	}
+}
+
+// takeBudget 按输出预算截断文本，返回可输出部分以及是否超出预算
+func (t *responseTranslator) takeBudget(text string) (string, bool) {
+	if text == "" {
+		return "", false
+	}
+
+	runes := []rune(text)
+	if t.maxChars > 0 && t.outputChars+len(runes) > t.maxChars {
+		remaining := max(t.maxChars-t.outputChars, 0)
+		t.outputChars += remaining
+		return string(runes[:remaining]), true
+	}
+
+	t.outputChars += len(runes)
+	return text, false
+}
+
+// stop 提前结束输出
+func (t *responseTranslator) stop(reason string, stopSequence *string) {
+	t.done = true
+	t.stopReason = reason
+	t.stopSequence = stopSequence
+}
+
+// thinkingText 输出推理内容，未启用 extended thinking 时丢弃
+func (t *responseTranslator) thinkingText(thinking string) {
+	if !t.thinking || thinking == "" {
+		return
+	}
+	if t.openType != "thinking" {
+		t.flushText()
+		if t.done {
+			return
+		}
+		t.closeBlock()
+		t.openBlock("thinking", map[string]any{"type": "thinking", "thinking": "", "signature": ""})
+	}
+
+	thinking, truncated := t.takeBudget(thinking)
+	if thinking != "" {
+		t.emit("content_block_delta", map[string]any{
+			"type":  "content_block_delta",
+			"index": t.openIndex,
+			"delta": map[string]any{
+				"type":     "thinking_delta",
+				"thinking": thinking,
+			},
+		})
+	}
+	if truncated {
+		t.stop(stopReasonMaxTokens, nil)
+	}
+}
+
+// signature 输出当前 thinking 块的签名
+func (t *responseTranslator) signature(signature string) {
+	if t.openType != "thinking" || signature == "" {
+		return
+	}
+	t.emit("content_block_delta", map[string]any{
+		"type":  "content_block_delta",
+		"index": t.openIndex,
+		"delta": map[string]any{
+			"type":      "signature_delta",
+			"signature": signature,
+		},
+	})
+}
+
+// redactedThinking 输出一个完整的 redacted_thinking 块
+func (t *responseTranslator) redactedThinking(data string) {
+	if !t.thinking || data == "" {
+		return
+	}
+	t.flushText()
+	if t.done {
+		return
+	}
+	t.closeBlock()
+	t.openBlock("redacted_thinking", map[string]any{"type": "redacted_thinking", "data": data})
+	t.closeBlock()
+}
+
+// startToolUse 打开一个 tool_use 块。工具参数需要完整后才能校验，
+// 因此 tool_use 块的事件在块结束时才一并输出，见 closeToolUse
+func (t *responseTranslator) startToolUse(id, name string) {
+	if t.openType == "tool_use" && t.openToolId == id {
+		return
+	}
+	t.flushText()
+	if t.done {
+		return
+	}
+	t.closeBlock()
+	if t.done {
+		return
+	}
+	if original, ok := t.toolNames[name]; ok {
+		name = original
+	}
+
+	t.openType = "tool_use"
+	t.openIndex = t.nextIndex
+	t.nextIndex++
+	t.openToolId = id
+	t.openTool.name = name
+	t.openTool.input.Reset()
+}
+
+// inputJson 缓存 tool_use 块的参数片段
+func (t *responseTranslator) inputJson(partialJson string) {
+	partialJson, truncated := t.takeBudget(partialJson)
+	t.openTool.input.WriteString(partialJson)
+	if truncated {
+		t.stop(stopReasonMaxTokens, nil)
+	}
+}
+
+// closeToolUse 校验并修复工具参数后输出完整的 tool_use 块，无法修复时记录错误并结束输出。
+// 参数因 max_tokens 被截断时不输出该块，以 stop_reason max_tokens 结束
+func (t *responseTranslator) closeToolUse() {
+	name, raw := t.openTool.name, t.openTool.input.String()
+	t.openType = ""
+	t.openToolId = ""
+
+	if t.stopReason == stopReasonMaxTokens {
+		log.Printf("工具 %s 的参数因 max_tokens 被截断，不输出该工具调用, 原始参数: %s", name, raw)
+		t.nextIndex--
+		return
+	}
+
+	input, err := repairToolInput(raw, t.toolSchemas[name])
+	if err != nil {
+		log.Printf("工具 %s 的参数无法修复: %v, 原始参数: %s", name, err, raw)
+		t.nextIndex--
+		t.err = &toolInputError{Tool: name, Input: raw, Err: err}
+		t.done = true
+		return
+	}
+
+	t.hasToolUse = true
+	t.emit("content_block_start", map[string]any{
+		"type":  "content_block_start",
+		"index": t.openIndex,
+		"content_block": map[string]any{
+			"type":  "tool_use",
+			"id":    newToolUseId(),
+			"name":  name,
+			"input": map[string]any{},
+		},
+	})
+	t.emit("content_block_delta", map[string]any{
+		"type":  "content_block_delta",
+		"index": t.openIndex,
+		"delta": map[string]any{
+			"type":         "input_json_delta",
+			"partial_json": input,
+		},
+	})
+	t.emit("content_block_stop", map[string]any{
+		"type":  "content_block_stop",
+		"index": t.openIndex,
+	})
+}
+
+func (t *responseTranslator) openBlock(blockType string, contentBlock map[string]any) {
+	t.openType = blockType
+	t.openIndex = t.nextIndex
+	t.nextIndex++
+	t.emit("content_block_start", map[string]any{
+		"type":          "content_block_start",
+		"index":         t.openIndex,
+		"content_block": contentBlock,
+	})
+}
+
+func (t *responseTranslator) closeBlock() {
+	switch t.openType {
+	case "":
+		return
+	case "tool_use":
+		t.closeToolUse()
+		return
+	}
+	t.emit("content_block_stop", map[string]any{
+		"type":  "content_block_stop",
+		"index": t.openIndex,
+	})
+	t.openType = ""
+	t.openToolId = ""
+}
+
+// finish 关闭所有打开的内容块并返回最终的 stop_reason
+func (t *responseTranslator) finish() string {
+	if !t.done {
+		t.flushText()
+	}
+	t.closeBlock()
+
+	if t.stopReason == "" {
+		if t.hasToolUse {
+			t.stopReason = stopReasonToolUse
+		} else {
+			t.stopReason = stopReasonEndTurn
+		}
+	}
+	return t.stopReason
+}
+
+// stopSequenceValue 返回命中的 stop sequence，未命中时为 nil
+func (t *responseTranslator) stopSequenceValue() any {
+	if t.stopSequence == nil {
+		return nil
+	}
+	return *t.stopSequence
+}
+
+// messageDelta 构建最终的 message_delta 事件，必须在 finish 之后调用
+func (t *responseTranslator) messageDelta() map[string]any {
+	return map[string]any{
+		"type": "message_delta",
+		"delta": map[string]any{
+			"stop_reason":   t.stopReason,
+			"stop_sequence": t.stopSequenceValue(),
+		},
+		"usage": map[string]any{
+			"output_tokens": t.outputTokens(),
+		},
+	}
+}
+
+// contentCollector 收集转换后的内容块事件，用于构建非流式响应
+type contentCollector struct {
+	blocks      []map[string]any
+	partialJson map[int]*strings.Builder
+}
+
+func newContentCollector() *contentCollector {
+	return &contentCollector{blocks: []map[string]any{}, partialJson: map[int]*strings.Builder{}}
+}
+
+// collect 作为 responseTranslator 的 emit 函数使用
+func (c *contentCollector) collect(eventType string, data any) {
+	dataMap, _ := data.(map[string]any)
+	index, _ := dataMap["index"].(int)
+
+	switch eventType {
+	case "content_block_start":
+		block := map[string]any{}
+		for k, v := range dataMap["content_block"].(map[string]any) {
+			block[k] = v
+		}
+		c.blocks = append(c.blocks, block)
+	case "content_block_delta":
+		if index >= len(c.blocks) {
+			return
+		}
+		delta, _ := dataMap["delta"].(map[string]any)
+		switch delta["type"] {
+		case "text_delta":
+			c.blocks[index]["text"] = c.blocks[index]["text"].(string) + delta["text"].(string)
+		case "thinking_delta":
+			c.blocks[index]["thinking"] = c.blocks[index]["thinking"].(string) + delta["thinking"].(string)
+		case "signature_delta":
+			c.blocks[index]["signature"] = delta["signature"]
+		case "input_json_delta":
+			if c.partialJson[index] == nil {
+				c.partialJson[index] = &strings.Builder{}
+			}
+			c.partialJson[index].WriteString(delta["partial_json"].(string))
+		}
+	case "content_block_stop":
+		if index >= len(c.blocks) || c.blocks[index]["type"] != "tool_use" {
+			return
+		}
+		toolInput := map[string]any{}
+		if sb := c.partialJson[index]; sb != nil && sb.Len() > 0 {
+			if err := jsonStr.Unmarshal([]byte(sb.String()), &toolInput); err != nil {
+				log.Printf("json unmarshal error:%s", err.Error())
+			}
+		}
+		c.blocks[index]["input"] = toolInput
+	}
+}
+
+// partialJsonString 将解析器输出的 partial_json 统一转换为字符串
+func partialJsonString(v any) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case *string:
+		if s != nil {
+			return *s
+		}
+	default:
+		log.Println("partial_json is not string or *string")
+	}
+	return ""
+}
+
+// findStopSequence 查找最早出现的 stop sequence，返回位置和匹配的序列，未找到返回 -1
+func findStopSequence(text string, stopSequences []string) (int, string) {
+	index, matched := -1, ""
+	for _, seq := range stopSequences {
+		if i := strings.Index(text, seq); i >= 0 && (index < 0 || i < index) {
+			index, matched = i, seq
+		}
+	}
+	return index, matched
+}
+
+// stopSequencePrefixLen 返回 text 末尾与任一 stop sequence 前缀匹配的最大长度
+func stopSequencePrefixLen(text string, stopSequences []string) int {
+	keep := 0
+	for _, seq := range stopSequences {
+		for n := min(len(seq)-1, len(text)); n > keep; n-- {
+			if strings.HasSuffix(text, seq[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	return keep
+}
+
+// charsPerToken 估算 token 时每个 token 对应的字符数
+const charsPerToken = 4
+
+// estimateTokens 粗略估算文本的 token 数量
+func estimateTokens(s string) int {
+	return (len([]rune(s)) + charsPerToken - 1) / charsPerToken
+}
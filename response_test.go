@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bestk/kiro2cc/parser"
+)
+
+func textEvent(text string) parser.SSEEvent {
+	return parser.SSEEvent{
+		Event: "content_block_delta",
+		Data: map[string]any{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]any{"type": "text_delta", "text": text},
+		},
+	}
+}
+
+func toolEvents(id, name, input string) []parser.SSEEvent {
+	return []parser.SSEEvent{
+		{Event: "content_block_start", Data: map[string]any{
+			"type":          "content_block_start",
+			"content_block": map[string]any{"type": "tool_use", "id": id, "name": name},
+		}},
+		{Event: "content_block_delta", Data: map[string]any{
+			"type":  "content_block_delta",
+			"delta": map[string]any{"type": "input_json_delta", "id": id, "name": name, "partial_json": &input},
+		}},
+		{Event: "content_block_stop", Data: map[string]any{"type": "content_block_stop"}},
+	}
+}
+
+// translate 将事件依次交给转换器，返回收集到的内容块
+func translate(req AnthropicRequest, events []parser.SSEEvent) (*responseTranslator, []map[string]any) {
+	collector := newContentCollector()
+	translator := newResponseTranslator(req, collector.collect)
+	for _, e := range events {
+		if translator.stopped() {
+			break
+		}
+		translator.handle(e)
+	}
+	translator.finish()
+	return translator, collector.blocks
+}
+
+func TestTranslatorStopReason(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        AnthropicRequest
+		events     []parser.SSEEvent
+		wantReason string
+		wantSeq    any
+		wantText   string
+	}{
+		{
+			name:       "end turn",
+			events:     []parser.SSEEvent{textEvent("Hello"), textEvent(" world")},
+			wantReason: stopReasonEndTurn,
+			wantText:   "Hello world",
+		},
+		{
+			name:       "tool use",
+			events:     append([]parser.SSEEvent{textEvent("Reading")}, toolEvents("t1", "Read", `{"file_path":"a"}`)...),
+			wantReason: stopReasonToolUse,
+			wantText:   "Reading",
+		},
+		{
+			name:       "stop sequence split across deltas",
+			req:        AnthropicRequest{StopSequences: []string{"</answer>"}},
+			events:     []parser.SSEEvent{textEvent("42</ans"), textEvent("wer> trailing")},
+			wantReason: stopReasonStopSequence,
+			wantSeq:    "</answer>",
+			wantText:   "42",
+		},
+		{
+			name:       "held prefix is flushed when no match",
+			req:        AnthropicRequest{StopSequences: []string{"STOP"}},
+			events:     []parser.SSEEvent{textEvent("go ST"), textEvent("ay")},
+			wantReason: stopReasonEndTurn,
+			wantText:   "go STay",
+		},
+		{
+			name:       "max tokens",
+			req:        AnthropicRequest{MaxTokens: 2},
+			events:     []parser.SSEEvent{textEvent("abcdef"), textEvent("ghijkl")},
+			wantReason: stopReasonMaxTokens,
+			wantText:   "abcdefgh",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			translator, blocks := translate(tt.req, tt.events)
+			if translator.stopReason != tt.wantReason {
+				t.Fatalf("stop_reason = %q, want %q", translator.stopReason, tt.wantReason)
+			}
+			if translator.stopSequenceValue() != tt.wantSeq {
+				t.Fatalf("stop_sequence = %v, want %v", translator.stopSequenceValue(), tt.wantSeq)
+			}
+
+			var text strings.Builder
+			for _, b := range blocks {
+				if b["type"] == "text" {
+					text.WriteString(b["text"].(string))
+				}
+			}
+			if text.String() != tt.wantText {
+				t.Fatalf("text = %q, want %q", text.String(), tt.wantText)
+			}
+		})
+	}
+}
+
+func TestTranslatorBlockIndexes(t *testing.T) {
+	var events []parser.SSEEvent
+	events = append(events, textEvent("a"))
+	events = append(events, toolEvents("t1", "Read", `{}`)...)
+	events = append(events, toolEvents("t2", "Write", `{}`)...)
+
+	_, blocks := translate(AnthropicRequest{}, events)
+	if len(blocks) != 3 {
+		t.Fatalf("got %d blocks, want 3", len(blocks))
+	}
+	if blocks[1]["name"] != "Read" || blocks[2]["name"] != "Write" {
+		t.Fatalf("unexpected blocks: %v", blocks)
+	}
+	id1, id2 := blocks[1]["id"].(string), blocks[2]["id"].(string)
+	if !strings.HasPrefix(id1, "toolu_") || id1 == id2 {
+		t.Fatalf("tool_use ids must be unique Anthropic ids: %q, %q", id1, id2)
+	}
+}
+
+func TestTranslatorThinking(t *testing.T) {
+	events := []parser.SSEEvent{
+		{Event: "content_block_delta", Data: map[string]any{
+			"delta": map[string]any{"type": "thinking_delta", "thinking": "hmm"},
+		}},
+		{Event: "content_block_delta", Data: map[string]any{
+			"delta": map[string]any{"type": "signature_delta", "signature": "sig"},
+		}},
+		textEvent("answer"),
+	}
+
+	enabled := AnthropicRequest{Thinking: &AnthropicThinking{Type: "enabled", BudgetTokens: 1024}}
+	_, blocks := translate(enabled, events)
+	if len(blocks) != 2 || blocks[0]["type"] != "thinking" || blocks[1]["type"] != "text" {
+		t.Fatalf("unexpected blocks: %v", blocks)
+	}
+	if blocks[0]["thinking"] != "hmm" || blocks[0]["signature"] != "sig" {
+		t.Fatalf("unexpected thinking block: %v", blocks[0])
+	}
+
+	_, blocks = translate(AnthropicRequest{}, events)
+	if len(blocks) != 1 || blocks[0]["type"] != "text" {
+		t.Fatalf("thinking should be dropped when not enabled: %v", blocks)
+	}
+}
+
+func TestGetMessageContentStripsThinking(t *testing.T) {
+	content := []any{
+		map[string]any{"type": "thinking", "thinking": "secret", "signature": "sig"},
+		map[string]any{"type": "redacted_thinking", "data": "abc"},
+		map[string]any{"type": "text", "text": "visible"},
+	}
+	if got := getMessageContent(content); got != "visible" {
+		t.Fatalf("getMessageContent() = %q, want %q", got, "visible")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// runClient 实现 kiro2cc run 命令：在本进程内启动只监听本机随机端口的代理服务器，
+// 生成一次性的客户端 key，设置好环境变量后运行 args 指定的命令，命令退出后关闭代理服务器。
+// 返回命令的退出码
+func runClient(args []string) (int, error) {
+	if len(args) > 0 && args[0] == "--" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return 0, errors.New("用法: kiro2cc run -- <命令> [参数...]，例如 kiro2cc run -- claude")
+	}
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return 0, fmt.Errorf("找不到命令 %s: %v", args[0], err)
+	}
+	if _, err := getToken(); err != nil {
+		return 0, fmt.Errorf("%v，请先安装 Kiro 并登录", err)
+	}
+
+	key, err := newClientKey()
+	if err != nil {
+		return 0, fmt.Errorf("生成客户端 key 失败: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("监听本机端口失败: %v", err)
+	}
+	baseURL := "http://" + listener.Addr().String()
+
+	// 代理服务器的日志写入文件，避免打乱子进程的终端界面
+	stdout, stderr := os.Stdout, os.Stderr
+	logPath, restore, err := redirectServerOutput()
+	if err != nil {
+		listener.Close()
+		return 0, err
+	}
+	defer restore()
+
+	shutdownTracing, err := setupTracing(config().Tracing)
+	if err != nil {
+		listener.Close()
+		return 0, fmt.Errorf("开启链路追踪失败: %v", err)
+	}
+	server := newServer(listener.Addr().String(), config().Server)
+	server.Handler = requireClientKey(key, server.Handler)
+	go server.Serve(listener)
+	fmt.Fprintf(stderr, "kiro2cc 代理服务器已在 %s 启动，日志写入 %s\n", baseURL, logPath)
+
+	cmd := exec.Command(path, args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, stdout, stderr
+	cmd.Env = runEnv(os.Environ(), baseURL, key)
+
+	// 终端按下 Ctrl+C 时子进程会直接收到 SIGINT，这里只需忽略，避免代理先于子进程退出；
+	// 不在终端中运行时 SIGINT 只会发给本进程，与单独发给本进程的 SIGTERM、SIGHUP 一样转发给子进程
+	forwardInterrupt := !stdinIsTerminal()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		server.Close()
+		return 0, fmt.Errorf("启动 %s 失败: %v", args[0], err)
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig != os.Interrupt || forwardInterrupt {
+					cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	waitErr := cmd.Wait()
+	close(done)
+
+	shutdownServer(server, shutdownGracePeriod)
+	tracingCtx, cancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer cancel()
+	if err := shutdownTracing(tracingCtx); err != nil {
+		fmt.Printf("导出追踪数据失败: %v\n", err)
+	}
+
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		return 0, waitErr
+	}
+	return exitCode(cmd.ProcessState), nil
+}
+
+// exitCode 返回子进程的退出码，被信号终止时按 shell 的惯例返回 128 加信号值
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	if code := state.ExitCode(); code >= 0 {
+		return code
+	}
+	return 1
+}
+
+// stdinIsTerminal 判断标准输入是否为终端，重定向自 /dev/null 时不算
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	devNull, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(info, devNull)
+}
+
+// newClientKey 生成一次性的客户端 key
+func newClientKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "kiro2cc-run-" + hex.EncodeToString(b), nil
+}
+
+// requireClientKey 只允许携带指定客户端 key 的请求，防止本机其他程序使用该代理
+func requireClientKey(key string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(clientKey(r)), []byte(key)) != 1 {
+			writeAnthropicError(w, newAnthropicError(http.StatusUnauthorized, "Invalid API key for this kiro2cc run session"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// runEnv 返回子进程的环境变量，将 Anthropic 客户端指向本地代理。
+// 去掉 ANTHROPIC_AUTH_TOKEN，避免客户端同时使用两种认证方式
+func runEnv(environ []string, baseURL, key string) []string {
+	overridden := []string{"ANTHROPIC_BASE_URL", "ANTHROPIC_API_KEY", "ANTHROPIC_AUTH_TOKEN"}
+	env := make([]string, 0, len(environ)+2)
+	for _, entry := range environ {
+		name, _, _ := strings.Cut(entry, "=")
+		keep := true
+		for _, o := range overridden {
+			// Windows 的环境变量名不区分大小写
+			if strings.EqualFold(name, o) {
+				keep = false
+			}
+		}
+		if keep {
+			env = append(env, entry)
+		}
+	}
+	return append(env, "ANTHROPIC_BASE_URL="+baseURL, "ANTHROPIC_API_KEY="+key)
+}
+
+// redirectServerOutput 将代理服务器的输出和日志追加写入 ~/.kiro2cc/run.log，返回日志路径和恢复函数
+func redirectServerOutput() (string, func(), error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", nil, fmt.Errorf("获取用户目录失败: %v", err)
+	}
+	path := filepath.Join(homeDir, ".kiro2cc", "run.log")
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", nil, fmt.Errorf("创建日志目录失败: %v", err)
+	}
+	logFile, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return "", nil, fmt.Errorf("打开日志文件失败: %v", err)
+	}
+
+	stdout, logWriter := os.Stdout, log.Writer()
+	os.Stdout = logFile
+	log.SetOutput(logFile)
+	return path, func() {
+		os.Stdout = stdout
+		log.SetOutput(logWriter)
+		logFile.Close()
+	}, nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRunHelperProcess 作为 kiro2cc run 启动的子进程运行：用环境变量中的地址和 key 访问代理，
+// 全部符合预期时以退出码 3 退出
+func TestRunHelperProcess(t *testing.T) {
+	if os.Getenv("KIRO2CC_RUN_HELPER") != "1" {
+		return
+	}
+
+	baseURL, key := os.Getenv("ANTHROPIC_BASE_URL"), os.Getenv("ANTHROPIC_API_KEY")
+	if !strings.HasPrefix(baseURL, "http://127.0.0.1:") || !strings.HasPrefix(key, "kiro2cc-run-") || os.Getenv("ANTHROPIC_AUTH_TOKEN") != "" {
+		os.Exit(10)
+	}
+
+	for apiKey, want := range map[string]int{key: http.StatusOK, "other-key": http.StatusUnauthorized} {
+		req := messagesRequest(false)
+		proxyReq, _ := http.NewRequest(http.MethodPost, baseURL+"/v1/messages", req.Body)
+		proxyReq.Header.Set("x-api-key", apiKey)
+		resp, err := http.DefaultClient.Do(proxyReq)
+		if err != nil {
+			os.Exit(11)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			os.Exit(12)
+		}
+	}
+	os.Exit(3)
+}
+
+// TestRunInterruptHelperProcess 作为 kiro2cc run 启动的子进程运行：向父进程发送 SIGINT，
+// 收到父进程转发回来的 SIGINT 时以退出码 4 退出
+func TestRunInterruptHelperProcess(t *testing.T) {
+	if os.Getenv("KIRO2CC_RUN_HELPER") != "interrupt" {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	parent, err := os.FindProcess(os.Getppid())
+	if err != nil {
+		os.Exit(14)
+	}
+	parent.Signal(os.Interrupt)
+	select {
+	case <-signals:
+		os.Exit(4)
+	case <-time.After(5 * time.Second):
+		os.Exit(13)
+	}
+}
+
+func TestRunClient(t *testing.T) {
+	setupFakeUpstream(t)
+	t.Setenv("KIRO2CC_RUN_HELPER", "1")
+	t.Setenv("ANTHROPIC_AUTH_TOKEN", "stale-token")
+
+	code, err := runClient([]string{"--", os.Args[0], "-test.run=^TestRunHelperProcess$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 3 {
+		t.Fatalf("exit code = %d, want 3", code)
+	}
+
+	// 代理服务器的日志写入文件，不输出到终端
+	home, _ := os.UserHomeDir()
+	logData, err := os.ReadFile(filepath.Join(home, ".kiro2cc", "run.log"))
+	if err != nil || !strings.Contains(string(logData), "Anthropic 请求体") {
+		t.Fatalf("run.log = %q, %v", logData, err)
+	}
+
+	if _, err := runClient([]string{"--"}); err == nil {
+		t.Fatal("missing command accepted")
+	}
+	if _, err := runClient([]string{"kiro2cc-no-such-command"}); err == nil {
+		t.Fatal("unknown command accepted")
+	}
+}
+
+func TestRunClientForwardsInterrupt(t *testing.T) {
+	if stdinIsTerminal() {
+		t.Skip("stdin is a terminal, SIGINT is not forwarded")
+	}
+	setupFakeUpstream(t)
+	t.Setenv("KIRO2CC_RUN_HELPER", "interrupt")
+
+	code, err := runClient([]string{os.Args[0], "-test.run=^TestRunInterruptHelperProcess$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != 4 {
+		t.Fatalf("exit code = %d, want 4", code)
+	}
+}
+
+func TestRunEnv(t *testing.T) {
+	env := runEnv([]string{"PATH=/bin", "ANTHROPIC_API_KEY=old", "anthropic_base_url=old", "ANTHROPIC_AUTH_TOKEN=old"}, "http://127.0.0.1:1", "k")
+	want := "PATH=/bin,ANTHROPIC_BASE_URL=http://127.0.0.1:1,ANTHROPIC_API_KEY=k"
+	if got := strings.Join(env, ","); got != want {
+		t.Fatalf("env = %s, want %s", got, want)
+	}
+}
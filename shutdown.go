@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errServerShutdown 服务器退出时中断进行中的流式响应的原因
+var errServerShutdown = errors.New("server is shutting down")
+
+// errStreamCancelled 通过管理接口中断流式响应的原因
+var errStreamCancelled = errors.New("stream cancelled by administrator")
+
+// shutdownGracePeriod 中断流式响应后等待其发送 error 事件的时间
+const shutdownGracePeriod = 5 * time.Second
+
+// activeStream 表示一个正在向客户端输出的流式响应
+type activeStream struct {
+	Id        string    `json:"id"`
+	Model     string    `json:"model"`
+	Client    string    `json:"client"`
+	Account   string    `json:"account"`
+	StartedAt time.Time `json:"started_at"`
+
+	cancel context.CancelCauseFunc
+}
+
+// streamRegistry 记录进行中的流式响应，退出时用于中断仍未结束的响应
+type streamRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*activeStream
+}
+
+// activeStreams 当前进行中的流式响应
+var activeStreams = &streamRegistry{streams: map[string]*activeStream{}}
+
+// add 登记一个流式响应，返回结束时调用的注销函数
+func (r *streamRegistry) add(stream *activeStream) (remove func()) {
+	r.mu.Lock()
+	r.streams[stream.Id] = stream
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.streams, stream.Id)
+		r.mu.Unlock()
+	}
+}
+
+// count 返回进行中的流式响应数量
+func (r *streamRegistry) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.streams)
+}
+
+// list 返回进行中的流式响应，按开始时间排序
+func (r *streamRegistry) list() []activeStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	streams := make([]activeStream, 0, len(r.streams))
+	for _, stream := range r.streams {
+		streams = append(streams, *stream)
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].StartedAt.Before(streams[j].StartedAt) })
+	return streams
+}
+
+// cancel 以 cause 中断指定的流式响应，返回是否找到该响应
+func (r *streamRegistry) cancel(id string, cause error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stream, ok := r.streams[id]
+	if ok {
+		stream.cancel(cause)
+	}
+	return ok
+}
+
+// cancelAll 以 cause 中断所有进行中的流式响应，返回被中断的数量
+func (r *streamRegistry) cancelAll(cause error) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, stream := range r.streams {
+		stream.cancel(cause)
+	}
+	return len(r.streams)
+}
+
+// shutdownServer 停止接收新请求并等待进行中的请求结束，超过 timeout 后中断仍在输出的流式响应，
+// 被中断的流会收到一个 error 事件
+func shutdownServer(server *http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err == nil {
+		fmt.Printf("所有请求已结束，服务器已停止\n")
+		return
+	}
+
+	n := activeStreams.cancelAll(errServerShutdown)
+	fmt.Printf("等待超时，中断 %d 个进行中的流式响应\n", n)
+
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer graceCancel()
+	if err := server.Shutdown(graceCtx); err != nil {
+		server.Close()
+	}
+	fmt.Printf("服务器已停止\n")
+}
+
+// streamCancelError 返回流式响应被服务器退出或管理接口中断时发给客户端的错误，
+// 其他情况（包括客户端断开连接）返回 nil
+func streamCancelError(ctx context.Context) *anthropicError {
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errServerShutdown):
+		return newAnthropicError(statusOverloaded, "Server is shutting down")
+	case errors.Is(cause, errStreamCancelled):
+		return newAnthropicError(http.StatusInternalServerError, "The stream was cancelled by the proxy administrator")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownCutsOffActiveStreams(t *testing.T) {
+	setupFakeUpstream(t)
+
+	raw, err := os.ReadFile(filepath.Join("parser", "response.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 返回部分响应后一直不结束
+		w.Write(raw)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer upstream.Close()
+	codeWhispererURL = upstream.URL
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(listener.Addr().String(), defaultConfig().Server)
+	go server.Serve(listener)
+
+	req := messagesRequest(true)
+	resp, err := http.Post("http://"+listener.Addr().String()+"/v1/messages", "application/json", req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for activeStreams.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("stream was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		shutdownServer(server, 100*time.Millisecond)
+		close(done)
+	}()
+
+	body, _ := io.ReadAll(resp.Body)
+	select {
+	case <-done:
+	case <-time.After(shutdownGracePeriod):
+		t.Fatal("shutdown did not finish")
+	}
+
+	events := string(body)
+	if !strings.Contains(events, "event: message_start") {
+		t.Fatalf("stream did not start: %s", events)
+	}
+	if !strings.Contains(events, "event: error") || !strings.Contains(events, "overloaded_error") {
+		t.Fatalf("cut-off stream did not receive an error event: %s", events)
+	}
+	if strings.Contains(events, "event: message_stop") {
+		t.Fatalf("cut-off stream must not end with message_stop: %s", events)
+	}
+	if n := activeStreams.count(); n != 0 {
+		t.Fatalf("%d streams still registered after shutdown", n)
+	}
+}
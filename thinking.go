@@ -0,0 +1,13 @@
+package main
+
+// AnthropicThinking 表示 Anthropic API 的 extended thinking 参数
+type AnthropicThinking struct {
+	Type         string `json:"type"` // enabled, disabled
+	BudgetTokens int    `json:"budget_tokens,omitempty"`
+}
+
+// thinkingEnabled 返回请求是否启用了 extended thinking。
+// CodeWhisperer 没有对应参数，启用后仅在上游输出推理内容时转换为 thinking 块
+func thinkingEnabled(anthropicReq AnthropicRequest) bool {
+	return anthropicReq.Thinking != nil && anthropicReq.Thinking.Type == "enabled"
+}
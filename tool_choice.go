@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/bestk/kiro2cc/parser"
+)
+
+// AnthropicToolChoice 表示 Anthropic API 的 tool_choice 参数
+type AnthropicToolChoice struct {
+	Type                   string `json:"type"` // auto, any, tool, none
+	Name                   string `json:"name,omitempty"`
+	DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+}
+
+// toolChoiceRetries 模型未按 tool_choice 调用工具时的重试次数
+const toolChoiceRetries = 1
+
+// validateToolChoice 检查 tool_choice 参数是否合法
+func validateToolChoice(anthropicReq AnthropicRequest) error {
+	choice := anthropicReq.ToolChoice
+	if choice == nil {
+		return nil
+	}
+
+	switch choice.Type {
+	case "auto", "none":
+		return nil
+	case "any":
+		if len(anthropicReq.Tools) == 0 {
+			return errors.New("tool_choice.type any requires tools")
+		}
+		return nil
+	case "tool":
+		for _, tool := range anthropicReq.Tools {
+			if tool.Name == choice.Name {
+				return nil
+			}
+		}
+		return fmt.Errorf("tool_choice.name %q does not match any tool", choice.Name)
+	default:
+		return fmt.Errorf("unsupported tool_choice.type %q", choice.Type)
+	}
+}
+
+// toolsDisabled 返回本轮是否禁止调用工具
+func toolsDisabled(anthropicReq AnthropicRequest) bool {
+	return anthropicReq.ToolChoice != nil && anthropicReq.ToolChoice.Type == "none"
+}
+
+// requiresToolUse 返回本轮是否必须调用工具
+func requiresToolUse(anthropicReq AnthropicRequest) bool {
+	if anthropicReq.ToolChoice == nil || len(anthropicReq.Tools) == 0 {
+		return false
+	}
+	return anthropicReq.ToolChoice.Type == "any" || anthropicReq.ToolChoice.Type == "tool"
+}
+
+// toolChoiceInstruction 返回附加在当前用户消息后的引导指令，CodeWhisperer 没有 tool_choice 参数
+func toolChoiceInstruction(anthropicReq AnthropicRequest) string {
+	if !requiresToolUse(anthropicReq) {
+		return ""
+	}
+
+	choice := anthropicReq.ToolChoice
+	var instruction string
+	if choice.Type == "tool" {
+		// 上游看到的是改写后的工具名
+		toSanitized, _ := toolNameMapping(anthropicReq.Tools)
+		instruction = fmt.Sprintf("You must respond by calling the `%s` tool. Do not answer with plain text.", toSanitized[choice.Name])
+	} else {
+		instruction = "You must respond by calling one of the available tools. Do not answer with plain text."
+	}
+	if choice.DisableParallelToolUse {
+		instruction += " Call exactly one tool."
+	}
+	return instruction
+}
+
+// requiredToolName 返回 tool_choice 指定的工具在上游的名称，type 为 any 时返回空字符串
+func requiredToolName(anthropicReq AnthropicRequest) string {
+	if anthropicReq.ToolChoice == nil || anthropicReq.ToolChoice.Type != "tool" {
+		return ""
+	}
+	toSanitized, _ := toolNameMapping(anthropicReq.Tools)
+	return toSanitized[anthropicReq.ToolChoice.Name]
+}
+
+// fetchRequiredToolUse 读取完整的上游响应并检查模型是否调用了 tool_choice 要求的工具，
+// 未调用时重试，仍未调用则返回 502 错误。required 为上游的工具名，为空时调用任意工具都可以。
+// 上游在事件流中返回异常时不做检查，直接返回异常对应的错误
+func fetchRequiredToolUse(ctx context.Context, cwReq CodeWhispererRequest, required, accessToken string) (eventSource, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := callCodeWhisperer(ctx, cwReq, accessToken)
+		if err != nil {
+			return nil, err
+		}
+
+		events, err := readAllEvents(ctx, resp)
+		if err != nil {
+			return nil, err
+		}
+		if exception := eventsException(events); exception != "" {
+			if apiErr := exceptionToAnthropicError(exception); apiErr != nil {
+				return nil, apiErr
+			}
+			// 输入过长的异常由转换器按 max_tokens 处理
+			return &bufferedEvents{events: events}, nil
+		}
+		choiceErr := checkToolChoice(events, required)
+		if choiceErr == nil {
+			return &bufferedEvents{events: events}, nil
+		}
+
+		if attempt >= toolChoiceRetries {
+			return nil, choiceErr
+		}
+		log.Printf("模型未按 tool_choice 调用工具（%s），重试第 %d 次", choiceErr.Message, attempt+1)
+	}
+}
+
+// eventsException 返回事件中上游返回的第一个异常，没有时返回空字符串
+func eventsException(events []parser.SSEEvent) string {
+	for _, e := range events {
+		if dataMap, ok := e.Data.(map[string]any); ok && e.Event == "exception" {
+			return exceptionMessage(dataMap)
+		}
+	}
+	return ""
+}
+
+// checkToolChoice 检查模型是否调用了要求的工具，required 为空时调用任意工具都可以。
+// 模型没有遵循指令不是请求本身的问题，返回 502 api_error
+func checkToolChoice(events []parser.SSEEvent, required string) *anthropicError {
+	called := calledToolNames(events)
+	if len(called) == 0 {
+		return newAnthropicError(http.StatusBadGateway, "The model answered in text although tool_choice required a tool call")
+	}
+	if required == "" {
+		return nil
+	}
+	for _, name := range called {
+		if name != required {
+			return newAnthropicError(http.StatusBadGateway, "The model called tool %q although tool_choice required %q", name, required)
+		}
+	}
+	return nil
+}
+
+// calledToolNames 返回事件中调用的工具名（上游的名称），按首次出现的顺序去重
+func calledToolNames(events []parser.SSEEvent) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, e := range events {
+		dataMap, ok := e.Data.(map[string]any)
+		if !ok {
+			continue
+		}
+		var name any
+		switch e.Event {
+		case "content_block_start":
+			if block, ok := dataMap["content_block"].(map[string]any); ok && block["type"] == "tool_use" {
+				name = block["name"]
+			}
+		case "content_block_delta":
+			if delta, ok := dataMap["delta"].(map[string]any); ok && delta["type"] == "input_json_delta" {
+				name = delta["name"]
+			}
+		}
+		if name, ok := name.(string); ok && name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
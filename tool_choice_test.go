@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bestk/kiro2cc/parser"
+)
+
+func TestToolChoice(t *testing.T) {
+	tools := []AnthropicTool{{Name: "extract", InputSchema: map[string]any{"type": "object"}}}
+	messages := []AnthropicRequestMessage{{Role: "user", Content: "hi"}}
+
+	tests := []struct {
+		name            string
+		choice          *AnthropicToolChoice
+		wantErr         bool
+		wantTools       int
+		wantInstruction string
+	}{
+		{name: "default", wantTools: 1},
+		{name: "auto", choice: &AnthropicToolChoice{Type: "auto"}, wantTools: 1},
+		{name: "none", choice: &AnthropicToolChoice{Type: "none"}, wantTools: 0},
+		{name: "any", choice: &AnthropicToolChoice{Type: "any"}, wantTools: 1, wantInstruction: "one of the available tools"},
+		{name: "tool", choice: &AnthropicToolChoice{Type: "tool", Name: "extract"}, wantTools: 1, wantInstruction: "`extract` tool"},
+		{name: "unknown tool", choice: &AnthropicToolChoice{Type: "tool", Name: "missing"}, wantErr: true},
+		{name: "unknown type", choice: &AnthropicToolChoice{Type: "required"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := AnthropicRequest{Messages: messages, Tools: tools, ToolChoice: tt.choice}
+			if err := validateToolChoice(req); (err != nil) != tt.wantErr {
+				t.Fatalf("validateToolChoice() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			cwReq := buildCodeWhispererRequest(req)
+			msg := cwReq.ConversationState.CurrentMessage.UserInputMessage
+			if got := len(msg.UserInputMessageContext.Tools); got != tt.wantTools {
+				t.Fatalf("tools = %d, want %d", got, tt.wantTools)
+			}
+			if tt.wantInstruction == "" && msg.Content != "hi" {
+				t.Fatalf("content = %q, want unchanged", msg.Content)
+			}
+			if !strings.Contains(msg.Content, tt.wantInstruction) {
+				t.Fatalf("content = %q, want instruction %q", msg.Content, tt.wantInstruction)
+			}
+		})
+	}
+}
+
+func TestCheckToolChoice(t *testing.T) {
+	toolStart := func(name string) parser.SSEEvent {
+		return parser.SSEEvent{Event: "content_block_start", Data: map[string]any{
+			"content_block": map[string]any{"type": "tool_use", "id": "t1", "name": name},
+		}}
+	}
+	text := parser.SSEEvent{Event: "content_block_delta", Data: map[string]any{
+		"delta": map[string]any{"type": "text_delta", "text": "hi"},
+	}}
+
+	tests := []struct {
+		name     string
+		events   []parser.SSEEvent
+		required string
+		wantErr  bool
+	}{
+		{name: "text only", events: []parser.SSEEvent{text}, wantErr: true},
+		{name: "any tool", events: []parser.SSEEvent{toolStart("search")}},
+		{name: "required tool", events: []parser.SSEEvent{toolStart("mcp_fs_read")}, required: "mcp_fs_read"},
+		{name: "other tool", events: []parser.SSEEvent{toolStart("search")}, required: "mcp_fs_read", wantErr: true},
+		{name: "extra tool", events: []parser.SSEEvent{toolStart("mcp_fs_read"), toolStart("search")}, required: "mcp_fs_read", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkToolChoice(tt.events, tt.required)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkToolChoice() = %v, wantErr %v", err, tt.wantErr)
+			}
+			// 模型没有遵循指令不是请求错误
+			if err != nil && (err.Status != http.StatusBadGateway || err.Type != "api_error") {
+				t.Fatalf("error = %d %s, want 502 api_error", err.Status, err.Type)
+			}
+		})
+	}
+}
+
+func TestToolChoiceKeepsUpstreamException(t *testing.T) {
+	throttledUpstream(t)
+
+	body := `{"model":"claude-sonnet-4-20250514","max_tokens":1024,` +
+		`"messages":[{"role":"user","content":"read /tmp/a.txt"}],` +
+		`"tools":[{"name":"Read","input_schema":{"type":"object"}}],"tool_choice":{"type":"any"}}`
+	rec := httptest.NewRecorder()
+	handleMessages(rec, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body)))
+	// 上游限流时仍然返回可重试的 429，而不是模型未调用工具的错误
+	checkErrorResponse(t, rec, http.StatusTooManyRequests, "rate_limit_error")
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	jsonStr "encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// toolInputError 表示模型返回的工具参数无法修复或不符合 input_schema
+type toolInputError struct {
+	Tool  string
+	Input string
+	Err   error
+}
+
+func (e *toolInputError) Error() string {
+	return fmt.Sprintf("invalid input for tool %s: %v", e.Tool, e.Err)
+}
+
+// repairToolInput 检查拼接完成的工具参数，必要时进行安全修复并按 input_schema 校验，
+// 返回紧凑的 JSON 字符串
+func repairToolInput(raw string, schema map[string]any) (string, error) {
+	input, err := parseToolInput(raw)
+	if err != nil {
+		repaired, repairErr := repairJSON(raw)
+		if repairErr != nil {
+			return "", repairErr
+		}
+		if input, err = parseToolInput(repaired); err != nil {
+			return "", err
+		}
+		debugf("工具参数已修复: %s => %s", raw, repaired)
+	}
+
+	if err := validateSchema(input, schema, "input"); err != nil {
+		return "", err
+	}
+
+	data, err := jsonStr.Marshal(input)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// parseToolInput 解析工具参数，空参数视为空对象，参数必须是 JSON 对象
+func parseToolInput(raw string) (map[string]any, error) {
+	if strings.TrimSpace(raw) == "" {
+		return map[string]any{}, nil
+	}
+
+	var input map[string]any
+	if err := jsonStr.Unmarshal([]byte(raw), &input); err != nil {
+		return nil, err
+	}
+	if input == nil {
+		return nil, fmt.Errorf("input is not a JSON object")
+	}
+	return input, nil
+}
+
+// repairJSON 只修复 JSON 的结构：去掉多余的逗号，补全未闭合的括号。
+// 截断位置在字符串中间、不完整的数字或 true、false、null 中间或键之后时无法知道原来的内容，返回错误而不是猜测
+func repairJSON(raw string) (string, error) {
+	var out strings.Builder
+	var stack []byte
+	inString, escaped := false, false
+
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if inString {
+			out.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{':
+			stack = append(stack, '}')
+		case '[':
+			stack = append(stack, ']')
+		case '}', ']':
+			trimTrailingComma(&out)
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+		out.WriteByte(c)
+	}
+
+	if inString {
+		return "", fmt.Errorf("input was cut off inside a string")
+	}
+	if len(stack) > 0 {
+		// 末尾的数字或 true、false、null 本身完整时直接补全括号，不完整时无法知道原来的值
+		if literal := trailingLiteral(raw); literal != "" && !jsonStr.Valid([]byte(literal)) {
+			return "", fmt.Errorf("input was cut off inside a value")
+		}
+		if strings.HasSuffix(strings.TrimRight(raw, " \t\r\n"), ":") {
+			return "", fmt.Errorf("input was cut off before a value")
+		}
+	}
+
+	trimTrailingComma(&out)
+	for i := len(stack) - 1; i >= 0; i-- {
+		out.WriteByte(stack[i])
+	}
+	return out.String(), nil
+}
+
+// trailingLiteral 返回 raw 末尾的数字或 true、false、null 字面量，末尾不是字面量时返回空字符串
+func trailingLiteral(raw string) string {
+	start := len(raw)
+	for start > 0 && isLiteralByte(raw[start-1]) {
+		start--
+	}
+	return raw[start:]
+}
+
+// isLiteralByte 判断 c 是否可能是数字或 true、false、null 字面量的一部分
+func isLiteralByte(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || c == '.' || c == '-' || c == '+' || c == 'E'
+}
+
+// trimTrailingComma 去掉已输出内容末尾的逗号
+func trimTrailingComma(out *strings.Builder) {
+	s := strings.TrimRight(out.String(), " \t\r\n")
+	if strings.HasSuffix(s, ",") {
+		out.Reset()
+		out.WriteString(s[:len(s)-1])
+	}
+}
+
+// validateSchema 按 JSON Schema 的常用关键字（type、required、properties、items、enum）校验参数。
+// 遇到无法处理的组合关键字时跳过校验，避免误报
+func validateSchema(value any, schema map[string]any, path string) error {
+	if schema == nil {
+		return nil
+	}
+	for _, keyword := range []string{"$ref", "anyOf", "oneOf", "allOf", "not"} {
+		if _, ok := schema[keyword]; ok {
+			return nil
+		}
+	}
+
+	if !matchesSchemaType(value, schema["type"]) {
+		return fmt.Errorf("%s: expected type %v, got %s", path, schema["type"], jsonTypeName(value))
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, candidate := range enum {
+			if fmt.Sprint(candidate) == fmt.Sprint(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value %v is not one of %v", path, value, enum)
+		}
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		if required, ok := schema["required"].([]any); ok {
+			for _, name := range required {
+				if key, ok := name.(string); ok {
+					if _, present := v[key]; !present {
+						return fmt.Errorf("%s: missing required property %q", path, key)
+					}
+				}
+			}
+		}
+		if props, ok := schema["properties"].(map[string]any); ok {
+			for key, propValue := range v {
+				if propSchema, ok := props[key].(map[string]any); ok {
+					if err := validateSchema(propValue, propSchema, path+"."+key); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	case []any:
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range v {
+				if err := validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchesSchemaType 检查值是否符合 schema 的 type，type 可以是字符串或字符串数组
+func matchesSchemaType(value any, schemaType any) bool {
+	switch t := schemaType.(type) {
+	case nil:
+		return true
+	case string:
+		return matchesType(value, t)
+	case []any:
+		for _, candidate := range t {
+			if name, ok := candidate.(string); ok && matchesType(value, name) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func matchesType(value any, typeName string) bool {
+	switch typeName {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		f, ok := value.(float64)
+		return ok && f == math.Trunc(f)
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRepairToolInput(t *testing.T) {
+	schema := map[string]any{
+		"type":     "object",
+		"required": []any{"file_path"},
+		"properties": map[string]any{
+			"file_path": map[string]any{"type": "string"},
+			"limit":     map[string]any{"type": "integer"},
+			"mode":      map[string]any{"type": "string", "enum": []any{"r", "w"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{name: "valid", raw: `{"file_path":"a.go","limit":10}`, want: `{"file_path":"a.go","limit":10}`},
+		{name: "unclosed brace", raw: `{"file_path":"a.go"`, want: `{"file_path":"a.go"}`},
+		{name: "cut inside string", raw: `{"file_path":"a.g`, wantErr: true},
+		{name: "cut inside escape", raw: `{"file_path":"a\`, wantErr: true},
+		{name: "complete number", raw: `{"file_path":"a.go","limit":1`, want: `{"file_path":"a.go","limit":1}`},
+		{name: "complete literal", raw: `{"file_path":"a.go","x":true`, want: `{"file_path":"a.go","x":true}`},
+		{name: "complete literal in array", raw: `{"file_path":"a.go","x":[null,false`, want: `{"file_path":"a.go","x":[null,false]}`},
+		{name: "cut inside number", raw: `{"file_path":"a.go","limit":1.`, wantErr: true},
+		{name: "cut after minus sign", raw: `{"file_path":"a.go","limit":-`, wantErr: true},
+		{name: "cut inside literal", raw: `{"file_path":"a.go","x":tr`, wantErr: true},
+		{name: "cut after key", raw: `{"file_path":"a.go","limit":`, wantErr: true},
+		{name: "trailing comma", raw: `{"file_path":"a.go","limit":1,}`, want: `{"file_path":"a.go","limit":1}`},
+		{name: "truncated after comma", raw: `{"file_path":"a.go",`, want: `{"file_path":"a.go"}`},
+		{name: "nested unclosed", raw: `{"file_path":"a.go","opts":{"x":[1,2]`, want: `{"file_path":"a.go","opts":{"x":[1,2]}}`},
+		{name: "comma inside string kept", raw: `{"file_path":"a,}.go",}`, want: `{"file_path":"a,}.go"}`},
+		{name: "missing required", raw: `{"limit":1}`, wantErr: true},
+		{name: "wrong type", raw: `{"file_path":"a.go","limit":1.5}`, wantErr: true},
+		{name: "enum mismatch", raw: `{"file_path":"a.go","mode":"x"}`, wantErr: true},
+		{name: "not json", raw: `file_path=a.go`, wantErr: true},
+		{name: "not an object", raw: `["a.go"]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := repairToolInput(tt.raw, schema)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("repairToolInput(%q) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("repairToolInput(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslatorRejectsUnrepairableToolInput(t *testing.T) {
+	req := AnthropicRequest{Tools: []AnthropicTool{{
+		Name:        "Read",
+		InputSchema: map[string]any{"type": "object", "required": []any{"file_path"}},
+	}}}
+
+	translator, blocks := translate(req, toolEvents("t1", "Read", `{"path":"a.go"}`))
+	if translator.err == nil {
+		t.Fatalf("expected error for input missing required property")
+	}
+	if len(blocks) != 0 {
+		t.Fatalf("invalid tool_use must not be emitted: %v", blocks)
+	}
+
+	translator, blocks = translate(req, toolEvents("t1", "Read", `{"file_path":"a.go",`))
+	if translator.err != nil {
+		t.Fatalf("unexpected error: %v", translator.err)
+	}
+	if input := blocks[0]["input"].(map[string]any); input["file_path"] != "a.go" {
+		t.Fatalf("unexpected input: %v", input)
+	}
+}
+
+func TestTranslatorDropsToolUseCutByMaxTokens(t *testing.T) {
+	req := AnthropicRequest{MaxTokens: 5, Tools: []AnthropicTool{{
+		Name:        "Write",
+		InputSchema: map[string]any{"type": "object", "required": []any{"file_path"}},
+	}}}
+
+	// 参数超出 max_tokens 的输出预算，截断的内容不能作为修复后的 tool_use 返回
+	translator, blocks := translate(req, toolEvents("t1", "Write", `{"file_path":"a.go","content":"package main"}`))
+	if translator.err != nil {
+		t.Fatalf("unexpected error: %v", translator.err)
+	}
+	if len(blocks) != 0 {
+		t.Fatalf("truncated tool_use must not be emitted: %v", blocks)
+	}
+	if translator.stopReason != stopReasonMaxTokens {
+		t.Fatalf("stop_reason = %s, want max_tokens", translator.stopReason)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 上游对工具定义的限制
+const (
+	maxToolNameLen        = 64
+	maxToolDescriptionLen = 10000
+)
+
+// invalidToolNameChars 匹配工具名中不允许的字符
+var invalidToolNameChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// unsupportedSchemaKeywords 上游不接受的 JSON Schema 关键字，会被直接删除
+var unsupportedSchemaKeywords = []string{"$schema", "$id", "$comment", "format", "examples"}
+
+// sanitizeToolName 将工具名改写为上游接受的形式，超长时截断并追加原名的哈希以保持唯一
+func sanitizeToolName(name string) string {
+	sanitized := invalidToolNameChars.ReplaceAllString(name, "_")
+	if sanitized == "" {
+		sanitized = "tool"
+	}
+	if len(sanitized) > maxToolNameLen {
+		sanitized = sanitized[:maxToolNameLen-9] + "_" + shortHash(name)
+	}
+	return sanitized
+}
+
+// shortHash 返回字符串的 8 位十六进制哈希
+func shortHash(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// toolNameMapping 返回本次请求中原始工具名与改写后工具名的双向映射。
+// 映射只依赖工具列表，构建请求和转换响应时分别计算得到的结果一致
+func toolNameMapping(tools []AnthropicTool) (toSanitized, toOriginal map[string]string) {
+	toSanitized = map[string]string{}
+	toOriginal = map[string]string{}
+
+	for _, tool := range tools {
+		if _, ok := toSanitized[tool.Name]; ok {
+			continue
+		}
+
+		sanitized := sanitizeToolName(tool.Name)
+		if _, taken := toOriginal[sanitized]; taken {
+			// 改写后与其他工具重名，追加原名哈希区分
+			suffix := "_" + shortHash(tool.Name)
+			sanitized = sanitized[:min(len(sanitized), maxToolNameLen-len(suffix))] + suffix
+		}
+
+		toSanitized[tool.Name] = sanitized
+		toOriginal[sanitized] = tool.Name
+	}
+
+	return toSanitized, toOriginal
+}
+
+// sanitizeTools 将 Anthropic 工具转换为上游接受的 CodeWhisperer 工具，并在调试日志中输出改写报告
+func sanitizeTools(tools []AnthropicTool) []CodeWhispererTool {
+	toSanitized, _ := toolNameMapping(tools)
+
+	var cwTools []CodeWhispererTool
+	var report []string
+	for _, tool := range tools {
+		cwTool := CodeWhispererTool{}
+
+		cwTool.ToolSpecification.Name = toSanitized[tool.Name]
+		if cwTool.ToolSpecification.Name != tool.Name {
+			report = append(report, fmt.Sprintf("工具名 %q 改写为 %q", tool.Name, cwTool.ToolSpecification.Name))
+		}
+
+		description := []rune(tool.Description)
+		if len(description) > maxToolDescriptionLen {
+			cwTool.ToolSpecification.Description = string(description[:maxToolDescriptionLen-3]) + "..."
+			report = append(report, fmt.Sprintf("工具 %q 的描述从 %d 字符截断为 %d 字符", tool.Name, len(description), maxToolDescriptionLen))
+		} else {
+			cwTool.ToolSpecification.Description = tool.Description
+		}
+
+		var removed []string
+		cwTool.ToolSpecification.InputSchema = InputSchema{
+			Json: sanitizeSchema(tool.InputSchema, "", &removed),
+		}
+		if len(removed) > 0 {
+			report = append(report, fmt.Sprintf("工具 %q 的 input_schema 删除了: %s", tool.Name, strings.Join(removed, ", ")))
+		}
+
+		cwTools = append(cwTools, cwTool)
+	}
+
+	for _, line := range report {
+		debugf("工具清理: %s", line)
+	}
+
+	return cwTools
+}
+
+// sanitizeSchema 递归复制 JSON Schema，删除上游不接受的关键字，removed 记录被删除内容的路径
+func sanitizeSchema(schema map[string]any, path string, removed *[]string) map[string]any {
+	result := map[string]any{}
+	for k, v := range schema {
+		result[k] = v
+	}
+
+	for _, keyword := range unsupportedSchemaKeywords {
+		if _, ok := result[keyword]; ok {
+			delete(result, keyword)
+			*removed = append(*removed, path+"/"+keyword)
+		}
+	}
+
+	// additionalProperties 只保留 object 类型上的布尔值
+	if v, ok := result["additionalProperties"]; ok {
+		if _, isBool := v.(bool); !isBool || result["type"] != "object" {
+			delete(result, "additionalProperties")
+			*removed = append(*removed, path+"/additionalProperties")
+		}
+	}
+
+	// 递归处理子 schema
+	for _, key := range []string{"properties", "definitions", "$defs", "patternProperties"} {
+		if props, ok := result[key].(map[string]any); ok {
+			sanitizedProps := map[string]any{}
+			for name, prop := range props {
+				if propSchema, ok := prop.(map[string]any); ok {
+					sanitizedProps[name] = sanitizeSchema(propSchema, path+"/"+key+"/"+name, removed)
+				} else {
+					sanitizedProps[name] = prop
+				}
+			}
+			result[key] = sanitizedProps
+		}
+	}
+	for _, key := range []string{"items", "not"} {
+		if sub, ok := result[key].(map[string]any); ok {
+			result[key] = sanitizeSchema(sub, path+"/"+key, removed)
+		}
+	}
+	for _, key := range []string{"anyOf", "oneOf", "allOf", "items"} {
+		if list, ok := result[key].([]any); ok {
+			sanitizedList := make([]any, len(list))
+			for i, item := range list {
+				if sub, ok := item.(map[string]any); ok {
+					sanitizedList[i] = sanitizeSchema(sub, fmt.Sprintf("%s/%s/%d", path, key, i), removed)
+				} else {
+					sanitizedList[i] = item
+				}
+			}
+			result[key] = sanitizedList
+		}
+	}
+
+	// 顶层必须是 object
+	if path == "" && result["type"] == nil {
+		result["type"] = "object"
+	}
+
+	return result
+}
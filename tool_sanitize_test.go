@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeToolName(t *testing.T) {
+	long := "mcp__" + strings.Repeat("very_long_server_name_", 4) + "search"
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "valid", in: "Read", want: "Read"},
+		{name: "invalid characters", in: "mcp.github/search issues", want: "mcp_github_search_issues"},
+		{name: "too long", in: long, want: long[:55] + "_" + shortHash(long)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeToolName(tt.in)
+			if got != tt.want {
+				t.Fatalf("sanitizeToolName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if len(got) > maxToolNameLen {
+				t.Fatalf("sanitized name too long: %d", len(got))
+			}
+		})
+	}
+}
+
+func TestToolNameMappingIsReversible(t *testing.T) {
+	tools := []AnthropicTool{{Name: "a.b"}, {Name: "a_b"}, {Name: "a/b"}}
+	toSanitized, toOriginal := toolNameMapping(tools)
+
+	seen := map[string]bool{}
+	for _, tool := range tools {
+		sanitized := toSanitized[tool.Name]
+		if seen[sanitized] {
+			t.Fatalf("duplicate sanitized name %q", sanitized)
+		}
+		seen[sanitized] = true
+		if toOriginal[sanitized] != tool.Name {
+			t.Fatalf("toOriginal[%q] = %q, want %q", sanitized, toOriginal[sanitized], tool.Name)
+		}
+	}
+
+	// 返回的 tool_use 使用原始工具名
+	req := AnthropicRequest{Tools: tools}
+	_, blocks := translate(req, toolEvents("t1", toSanitized["a/b"], `{}`))
+	if len(blocks) != 1 || blocks[0]["name"] != "a/b" {
+		t.Fatalf("unexpected blocks: %v", blocks)
+	}
+}
+
+func TestSanitizeSchema(t *testing.T) {
+	schema := map[string]any{
+		"$schema":              "http://json-schema.org/draft-07/schema#",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties": map[string]any{
+			"url":    map[string]any{"type": "string", "format": "uri"},
+			"format": map[string]any{"type": "string"},
+			"tags": map[string]any{
+				"type":                 "array",
+				"additionalProperties": false,
+				"items":                map[string]any{"type": "string", "format": "email"},
+			},
+		},
+	}
+
+	var removed []string
+	got := sanitizeSchema(schema, "", &removed)
+	sort.Strings(removed)
+
+	want := []string{
+		"/$schema",
+		"/properties/tags/additionalProperties",
+		"/properties/tags/items/format",
+		"/properties/url/format",
+	}
+	if strings.Join(removed, ",") != strings.Join(want, ",") {
+		t.Fatalf("removed = %v, want %v", removed, want)
+	}
+	if got["additionalProperties"] != false {
+		t.Fatalf("root additionalProperties should be kept: %v", got)
+	}
+	props := got["properties"].(map[string]any)
+	if _, ok := props["format"]; !ok {
+		t.Fatalf("property named format must be kept: %v", props)
+	}
+	if _, ok := schema["$schema"]; !ok {
+		t.Fatalf("original schema must not be modified")
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	jsonStr "encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// span 类型，取值与 OpenTelemetry 的 SpanKind 一致
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// span 表示一次被追踪的操作，字段与 OpenTelemetry 的 span 对应
+type span struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]any
+	Error        string
+
+	sampled bool
+	tracer  *tracer
+	mu      sync.Mutex
+}
+
+// spanExporter 接收已结束的 span
+type spanExporter interface {
+	export(s *span)
+	shutdown(ctx context.Context) error
+}
+
+// tracer 当前生效的追踪设置
+type tracer struct {
+	serviceName string
+	exporter    spanExporter
+}
+
+// currentTracer 为 nil 时不记录 span
+var currentTracer atomic.Pointer[tracer]
+
+type spanKey struct{}
+
+// spanFrom 返回 context 中当前的 span
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan 以 context 中当前的 span 为父 span 开始一个新的 span。
+// 未开启追踪时返回 nil，nil span 的方法都不做任何事
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	t := currentTracer.Load()
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{
+		SpanId:     randomHex(8),
+		Name:       name,
+		Kind:       spanKindInternal,
+		Start:      time.Now(),
+		Attributes: map[string]any{},
+		sampled:    true,
+		tracer:     t,
+	}
+	if parent := spanFrom(ctx); parent != nil {
+		s.TraceId = parent.TraceId
+		s.ParentSpanId = parent.SpanId
+		s.sampled = parent.sampled
+	} else {
+		s.TraceId = randomHex(16)
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// startServerSpan 为收到的请求开始一个 span，请求带有 W3C traceparent 时延续其中的 trace
+func startServerSpan(r *http.Request, name string) (context.Context, *span) {
+	ctx := r.Context()
+	if traceId, parentId, sampled, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, spanKey{}, &span{TraceId: traceId, SpanId: parentId, sampled: sampled})
+	}
+
+	ctx, s := startSpan(ctx, name)
+	if s != nil {
+		s.Kind = spanKindServer
+	}
+	return ctx, s
+}
+
+// parseTraceparent 解析 W3C traceparent 头，格式为 version-traceid-parentid-flags
+func parseTraceparent(header string) (traceId, parentId string, sampled, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return "", "", false, false
+	}
+	traceId, parentId, flags := parts[1], parts[2], parts[3]
+	if !isHex(traceId, 32) || !isHex(parentId, 16) || !isHex(flags, 2) ||
+		traceId == strings.Repeat("0", 32) || parentId == strings.Repeat("0", 16) {
+		return "", "", false, false
+	}
+	flagBits, _ := strconv.ParseUint(flags, 16, 8)
+	return traceId, parentId, flagBits&1 == 1, true
+}
+
+// isHex 判断 s 是否为长度为 n 的小写十六进制字符串
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex 返回 n 个随机字节的十六进制表示
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setAttr 设置 span 属性
+func (s *span) setAttr(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Attributes[key] = value
+	s.mu.Unlock()
+}
+
+// setError 将 span 标记为失败
+func (s *span) setError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.Error = err.Error()
+	s.mu.Unlock()
+}
+
+// end 结束 span 并交给 exporter
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.End.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.sampled {
+		s.tracer.exporter.export(s)
+	}
+}
+
+// setupTracing 按配置开启追踪，返回退出时调用的函数，用于发送尚未导出的 span
+func setupTracing(cfg TracingConfig) (shutdown func(context.Context) error, err error) {
+	exporterName := cfg.Exporter
+	endpoint := cfg.OTLPEndpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if exporterName == "" && endpoint != "" {
+		exporterName = "otlp"
+	}
+
+	var exporter spanExporter
+	switch exporterName {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter = &jsonLinesExporter{w: os.Stdout}
+	case "file":
+		if cfg.File == "" {
+			return nil, fmt.Errorf("tracing.file 未配置")
+		}
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("打开追踪文件失败: %v", err)
+		}
+		exporter = &jsonLinesExporter{w: f, closer: f}
+	case "otlp":
+		if endpoint == "" {
+			return nil, fmt.Errorf("tracing.otlp_endpoint 未配置")
+		}
+		exporter = newOTLPExporter(endpoint, cfg.ServiceName)
+	default:
+		return nil, fmt.Errorf("未知的 tracing.exporter: %s", exporterName)
+	}
+
+	currentTracer.Store(&tracer{serviceName: cfg.ServiceName, exporter: exporter})
+	return func(ctx context.Context) error {
+		currentTracer.Store(nil)
+		return exporter.shutdown(ctx)
+	}, nil
+}
+
+// spanRecord 文件和标准输出中每行 span 的格式
+type spanRecord struct {
+	TraceId      string         `json:"trace_id"`
+	SpanId       string         `json:"span_id"`
+	ParentSpanId string         `json:"parent_span_id,omitempty"`
+	Name         string         `json:"name"`
+	Start        time.Time      `json:"start"`
+	DurationMs   float64        `json:"duration_ms"`
+	Attributes   map[string]any `json:"attributes,omitempty"`
+	Error        string         `json:"error,omitempty"`
+}
+
+// jsonLinesExporter 将每个 span 以一行 JSON 写入文件或标准输出，便于离线查看
+type jsonLinesExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+func (e *jsonLinesExporter) export(s *span) {
+	s.mu.Lock()
+	data, err := jsonStr.Marshal(spanRecord{
+		TraceId:      s.TraceId,
+		SpanId:       s.SpanId,
+		ParentSpanId: s.ParentSpanId,
+		Name:         s.Name,
+		Start:        s.Start,
+		DurationMs:   float64(s.End.Sub(s.Start).Microseconds()) / 1000,
+		Attributes:   s.Attributes,
+		Error:        s.Error,
+	})
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.w.Write(append(data, '\n'))
+}
+
+func (e *jsonLinesExporter) shutdown(ctx context.Context) error {
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
+
+// OTLP 导出的批量参数
+const (
+	otlpBatchSize     = 128
+	otlpFlushInterval = 5 * time.Second
+	otlpQueueSize     = 2048
+)
+
+// otlpExporter 按 OTLP/HTTP JSON 格式批量发送 span 到 collector
+type otlpExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+
+	queue chan *span
+	done  chan struct{}
+
+	// closed 在 shutdown 后为 true，mu 保证 export 不会向已关闭的 queue 发送
+	mu     sync.Mutex
+	closed bool
+}
+
+// newOTLPExporter 创建 OTLP exporter，endpoint 为 collector 地址，如 http://localhost:4318
+func newOTLPExporter(endpoint, serviceName string) *otlpExporter {
+	e := &otlpExporter{
+		url:         strings.TrimRight(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *span, otlpQueueSize),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// export 将 span 放入发送队列，shutdown 后结束的 span（如服务器强制关闭后仍在处理的请求）直接丢弃
+func (e *otlpExporter) export(s *span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return
+	}
+	select {
+	case e.queue <- s:
+	default:
+		debugf("追踪队列已满，丢弃 span: %s", s.Name)
+	}
+}
+
+// run 攒够一批或每隔 otlpFlushInterval 发送一次，queue 关闭后发送剩余的 span
+func (e *otlpExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s, ok := <-e.queue:
+			if !ok {
+				e.send(batch)
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= otlpBatchSize {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *otlpExporter) shutdown(ctx context.Context) error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send 发送一批 span
+func (e *otlpExporter) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	body, err := jsonStr.Marshal(otlpTraces(e.serviceName, batch))
+	if err != nil {
+		log.Printf("序列化追踪数据失败: %v", err)
+		return
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("发送追踪数据失败: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(resp.Body)
+		log.Printf("发送追踪数据失败，状态码: %d, 响应: %s", resp.StatusCode, respBody)
+	}
+}
+
+// otlpTraces 构建 OTLP/HTTP JSON 请求体
+func otlpTraces(serviceName string, batch []*span) map[string]any {
+	spans := make([]map[string]any, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		otlpSpan := map[string]any{
+			"traceId":           s.TraceId,
+			"spanId":            s.SpanId,
+			"name":              s.Name,
+			"kind":              s.Kind,
+			"startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.Attributes),
+		}
+		if s.ParentSpanId != "" {
+			otlpSpan["parentSpanId"] = s.ParentSpanId
+		}
+		if s.Error != "" {
+			otlpSpan["status"] = map[string]any{"code": 2, "message": s.Error}
+		}
+		s.mu.Unlock()
+		spans = append(spans, otlpSpan)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{"service.name": serviceName}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "kiro2cc"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes 将属性转换为 OTLP 的 KeyValue 列表
+func otlpAttributes(attrs map[string]any) []map[string]any {
+	result := make([]map[string]any, 0, len(attrs))
+	for _, key := range sortedLabelKeys(attrs) {
+		var value map[string]any
+		switch v := attrs[key].(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, map[string]any{"key": key, "value": value})
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	jsonStr "encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	traceId, parentId, sampled, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || traceId != "4bf92f3577b34da6a3ce929d0e0e4736" || parentId != "00f067aa0ba902b7" || !sampled {
+		t.Fatalf("parseTraceparent = %s %s %v %v", traceId, parentId, sampled, ok)
+	}
+
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		if _, _, _, ok := parseTraceparent(header); ok {
+			t.Errorf("parseTraceparent(%q) accepted an invalid header", header)
+		}
+	}
+}
+
+// readSpans 读取文件 exporter 写出的 span
+func readSpans(t *testing.T, path string) map[string]spanRecord {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	spans := map[string]spanRecord{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record spanRecord
+		if err := jsonStr.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid span line %q: %v", scanner.Text(), err)
+		}
+		spans[record.Name] = record
+	}
+	return spans
+}
+
+func TestTracingFileExporter(t *testing.T) {
+	setupFakeUpstream(t)
+
+	path := filepath.Join(t.TempDir(), "spans.jsonl")
+	shutdown, err := setupTracing(TracingConfig{Exporter: "file", File: path, ServiceName: "kiro2cc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := newServer("", defaultConfig().Server).Handler
+	req := messagesRequest(true)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := readSpans(t, path)
+	server, ok := spans["POST /v1/messages"]
+	if !ok {
+		t.Fatalf("no server span in %v", spans)
+	}
+	if server.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanId != "00f067aa0ba902b7" {
+		t.Fatalf("server span did not continue the incoming trace: %+v", server)
+	}
+
+	for _, name := range []string{"getToken", "buildCodeWhispererRequest", "codewhisperer.generateAssistantResponse", "translateEvents"} {
+		child, ok := spans[name]
+		if !ok {
+			t.Errorf("missing span %s", name)
+			continue
+		}
+		if child.TraceId != server.TraceId || child.ParentSpanId != server.SpanId {
+			t.Errorf("span %s is not a child of the server span: %+v", name, child)
+		}
+	}
+	if events := spans["translateEvents"].Attributes["events"]; events == nil || events.(float64) == 0 {
+		t.Errorf("translateEvents events = %v", events)
+	}
+	for _, name := range []string{"decodeEvents", "writeEvents"} {
+		child, ok := spans[name]
+		if !ok {
+			t.Errorf("missing span %s", name)
+			continue
+		}
+		if child.ParentSpanId != spans["translateEvents"].SpanId || child.Attributes["busy_ms"] == nil {
+			t.Errorf("span %s is not a child of translateEvents: %+v", name, child)
+		}
+	}
+}
+
+func TestTracingOTLPExporter(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("collector path = %s", r.URL.Path)
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	shutdown, err := setupTracing(TracingConfig{OTLPEndpoint: collector.URL, ServiceName: "kiro2cc-test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, s := startSpan(context.Background(), "test-span")
+	s.setAttr("events", 3)
+	s.end()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceId    string `json:"traceId"`
+					Name       string `json:"name"`
+					Attributes []struct {
+						Key   string            `json:"key"`
+						Value map[string]string `json:"value"`
+					} `json:"attributes"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := jsonStr.Unmarshal(<-bodies, &payload); err != nil {
+		t.Fatal(err)
+	}
+	got := payload.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if got.Name != "test-span" || len(got.TraceId) != 32 || got.Attributes[0].Value["intValue"] != "3" {
+		t.Fatalf("exported span = %+v", got)
+	}
+}
+
+func TestOTLPExporterAfterShutdown(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+
+	shutdown, err := setupTracing(TracingConfig{OTLPEndpoint: collector.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 服务器强制关闭后仍在处理的请求在 shutdown 之后结束 span
+	_, s := startSpan(context.Background(), "late-span")
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s.end()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// sharedUpstreamClient 所有上游请求共用的 HTTP 客户端，复用连接池
+var sharedUpstreamClient atomic.Pointer[http.Client]
+
+// upstreamClient 返回共用的上游 HTTP 客户端，尚未创建时按当前配置创建
+func upstreamClient() *http.Client {
+	if client := sharedUpstreamClient.Load(); client != nil {
+		return client
+	}
+
+	client, err := newUpstreamClient(config().Upstream)
+	if err != nil {
+		// 配置错误在启动时已经检查过，这里退回到默认设置
+		fmt.Printf("创建上游 HTTP 客户端失败，使用默认设置: %v\n", err)
+		client, _ = newUpstreamClient(defaultConfig().Upstream)
+	}
+	if !sharedUpstreamClient.CompareAndSwap(nil, client) {
+		return sharedUpstreamClient.Load()
+	}
+	return client
+}
+
+// newUpstreamClient 按配置创建上游 HTTP 客户端。
+// 不设置整体超时，流式响应的持续时间由请求的 context 控制
+func newUpstreamClient(cfg UpstreamConfig) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyURL, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("代理地址无效: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CABundle != "" {
+		pool, err := loadCABundle(cfg.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   time.Duration(cfg.DialTimeout),
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   time.Duration(cfg.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: time.Duration(cfg.ResponseHeaderTimeout),
+		IdleConnTimeout:       time.Duration(cfg.IdleConnTimeout),
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		ExpectContinueTimeout: time.Second,
+		// 自定义了 TLSClientConfig 后需要显式开启 HTTP/2
+		ForceAttemptHTTP2: true,
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// loadCABundle 返回系统根证书加上 PEM 文件中证书的证书池
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 CA 证书文件失败: %v", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("CA 证书文件 %s 中没有有效的 PEM 证书", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewUpstreamClientCABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未配置 CA 证书时不信任测试服务器的自签名证书
+	client, err := newUpstreamClient(defaultConfig().Upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatal("request succeeded without the CA bundle")
+	}
+
+	cfg := defaultConfig().Upstream
+	cfg.CABundle = bundle
+	client, err = newUpstreamClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request with CA bundle: %v", err)
+	}
+	resp.Body.Close()
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	os.WriteFile(invalid, []byte("not a certificate"), 0600)
+	cfg.CABundle = invalid
+	if _, err := newUpstreamClient(cfg); err == nil {
+		t.Fatal("invalid CA bundle accepted")
+	}
+}
+
+func TestNewUpstreamClientProxy(t *testing.T) {
+	cfg := defaultConfig().Upstream
+	cfg.Proxy = "http://proxy.internal:3128"
+	client, err := newUpstreamClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, codeWhispererURL, nil)
+	proxyURL, err := client.Transport.(*http.Transport).Proxy(req)
+	if err != nil || proxyURL == nil || proxyURL.Host != "proxy.internal:3128" {
+		t.Fatalf("proxy = %v, %v, want proxy.internal:3128", proxyURL, err)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles 管理页面的静态文件，编译进二进制，不依赖外部 CDN
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// registerUIRoutes 在 /ui/ 下提供管理页面，页面通过 /admin 接口读取状态和执行操作
+func registerUIRoutes(mux *http.ServeMux) {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServerFS(files)))
+	mux.Handle("GET /ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+}
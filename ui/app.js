@@ -0,0 +1,191 @@
+// kiro2cc 管理页面，定期读取 /admin/status 并刷新页面
+
+const pollInterval = 2000;
+const tokenStorageKey = "kiro2cc-admin-token";
+
+// 上一次读取的请求数，用于计算请求速率
+let lastSample = null;
+
+// 管理页面地址带有 #token=... 时保存其中的 token，并从地址栏中去掉
+const hashToken = new URLSearchParams(location.hash.slice(1)).get("token");
+if (hashToken) {
+    localStorage.setItem(tokenStorageKey, hashToken);
+    history.replaceState(null, "", location.pathname + location.search);
+}
+
+// adminFetch 请求管理接口，token 无效时提示输入并保存在本地
+async function adminFetch(path, method = "GET") {
+    const headers = {};
+    const token = localStorage.getItem(tokenStorageKey);
+    if (token) {
+        headers["Authorization"] = "Bearer " + token;
+    }
+    const resp = await fetch(path, { method, headers });
+    if (resp.status === 401) {
+        const input = prompt("请输入管理 token（配置文件中的 admin.token，或 ~/.kiro2cc/admin-token 中保存的 token）");
+        if (input) {
+            localStorage.setItem(tokenStorageKey, input);
+            return adminFetch(path, method);
+        }
+    }
+    const body = await resp.json();
+    if (!resp.ok) {
+        throw new Error(body.error ? body.error.message : resp.statusText);
+    }
+    return body;
+}
+
+function formatTime(value) {
+    return value ? new Date(value).toLocaleString() : "-";
+}
+
+function formatDuration(seconds) {
+    if (seconds < 60) {
+        return Math.floor(seconds) + " 秒";
+    }
+    if (seconds < 3600) {
+        return Math.floor(seconds / 60) + " 分钟";
+    }
+    return Math.floor(seconds / 3600) + " 小时 " + Math.floor((seconds % 3600) / 60) + " 分钟";
+}
+
+// cell 创建表格单元格，文本通过 textContent 写入
+function cell(text, className) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    if (className) {
+        td.className = className;
+    }
+    return td;
+}
+
+function actionCell(label, onClick) {
+    const td = document.createElement("td");
+    const button = document.createElement("button");
+    button.textContent = label;
+    button.addEventListener("click", onClick);
+    td.appendChild(button);
+    return td;
+}
+
+// fillTable 用 rows 中的行替换表格内容
+function fillTable(id, rows, columns) {
+    const tbody = document.getElementById(id);
+    tbody.replaceChildren();
+    if (rows.length === 0) {
+        const tr = document.createElement("tr");
+        const td = cell("暂无", "empty");
+        td.colSpan = columns;
+        tr.appendChild(td);
+        tbody.appendChild(tr);
+        return;
+    }
+    for (const cells of rows) {
+        const tr = document.createElement("tr");
+        cells.forEach((td) => tr.appendChild(td));
+        tbody.appendChild(tr);
+    }
+}
+
+function showMessage(text, isError) {
+    const message = document.getElementById("message");
+    message.textContent = text;
+    message.className = isError ? "error" : "";
+    message.hidden = false;
+}
+
+// runAction 执行管理操作并刷新页面
+async function runAction(path, success) {
+    try {
+        const result = await adminFetch(path, "POST");
+        showMessage(success(result), false);
+    } catch (err) {
+        showMessage(err.message, true);
+    }
+    refresh();
+}
+
+function render(status) {
+    const now = Date.now();
+    document.getElementById("uptime").textContent = "已运行 " + formatDuration(status.uptime_seconds);
+
+    // Token 过期时间取第一个启用的账号
+    const account = status.accounts.find((a) => !a.disabled) || status.accounts[0];
+    const expiry = document.getElementById("token-expiry");
+    if (!account || account.token_error) {
+        expiry.textContent = account ? account.token_error : "-";
+        expiry.className = "value expired";
+    } else if (account.token_expires_at) {
+        const left = (new Date(account.token_expires_at).getTime() - now) / 1000;
+        expiry.textContent = left > 0 ? formatDuration(left) + "后" : "已过期";
+        expiry.className = left > 0 ? "value" : "value expired";
+    } else {
+        expiry.textContent = "未知";
+        expiry.className = "value";
+    }
+
+    if (lastSample) {
+        const minutes = (now - lastSample.time) / 60000;
+        const rate = (status.requests_total - lastSample.total) / minutes;
+        document.getElementById("request-rate").textContent = rate.toFixed(1);
+    }
+    lastSample = { time: now, total: status.requests_total };
+
+    const inFlight = status.in_flight_requests["/v1/messages"] || 0;
+    document.getElementById("in-flight").textContent = inFlight;
+    document.getElementById("requests-total").textContent = status.requests_total;
+
+    fillTable("accounts", status.accounts.map((a) => [
+        cell(a.name),
+        cell(a.health, a.health),
+        cell(a.token_error || formatTime(a.token_expires_at), a.token_expired || a.token_error ? "expired" : ""),
+        cell(a.last_refresh_error ? "失败: " + a.last_refresh_error : formatTime(a.last_refresh)),
+        cell(formatTime(a.last_success)),
+        cell(a.last_failure ? formatTime(a.last_failure) + " " + a.last_error : "-"),
+        a.disabled
+            ? actionCell("启用", () => runAction("/admin/accounts/" + encodeURIComponent(a.name) + "/enable", () => "已启用账号 " + a.name))
+            : actionCell("停用", () => runAction("/admin/accounts/" + encodeURIComponent(a.name) + "/disable", () => "已停用账号 " + a.name)),
+    ]), 7);
+
+    fillTable("streams", status.streams.map((s) => [
+        cell(s.id),
+        cell(s.model),
+        cell(s.client),
+        cell(formatDuration((now - new Date(s.started_at).getTime()) / 1000)),
+        actionCell("中断", () => runAction("/admin/streams/" + encodeURIComponent(s.id) + "/cancel", () => "已中断 " + s.id)),
+    ]), 5);
+
+    fillTable("requests", status.recent_requests.map((r) => [
+        cell(formatTime(r.time)),
+        cell(r.model || "-"),
+        cell(r.client),
+        cell(r.status, r.status >= 400 ? "status-error" : ""),
+        cell(r.latency_ms + " ms"),
+        cell(r.input_tokens),
+        cell(r.output_tokens),
+        cell(r.stop_reason || "-"),
+    ]), 8);
+
+    fillTable("errors", status.recent_errors.map((e) => [
+        cell(formatTime(e.time)),
+        cell(e.status, "status-error"),
+        cell(e.type),
+        cell(e.message, "message"),
+    ]), 4);
+}
+
+async function refresh() {
+    try {
+        render(await adminFetch("/admin/status"));
+    } catch (err) {
+        showMessage("读取状态失败: " + err.message, true);
+    }
+}
+
+document.getElementById("refresh-token").addEventListener("click", () =>
+    runAction("/admin/token/refresh", (r) => "Token 已刷新，过期时间 " + formatTime(r.expires_at)));
+document.getElementById("reload-config").addEventListener("click", () =>
+    runAction("/admin/config/reload", (r) => "已重新加载 " + r.path + "，server 和 tracing 配置需要重启后生效"));
+
+refresh();
+setInterval(refresh, pollInterval);
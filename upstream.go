@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	jsonStr "encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bestk/kiro2cc/parser"
+)
+
+// codeWhispererURL CodeWhisperer 对话接口地址
+var codeWhispererURL = "https://codewhisperer.us-east-1.amazonaws.com/generateAssistantResponse"
+
+// upstreamError 表示 CodeWhisperer 返回了非 200 状态码
+type upstreamError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration // 响应头 Retry-After 指定的等待时间
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("CodeWhisperer 响应错误，状态码: %d, 响应: %s", e.StatusCode, e.Body)
+}
+
+// upstreamConnError 表示没有收到 CodeWhisperer 的响应，如连接失败、连接被重置
+type upstreamConnError struct {
+	Err error
+}
+
+func (e *upstreamConnError) Error() string {
+	return fmt.Sprintf("CodeWhisperer reqeust error: %v", e.Err)
+}
+
+func (e *upstreamConnError) Unwrap() error {
+	return e.Err
+}
+
+// eventSource 表示上游事件的来源，可以是实时读取的响应流，也可以是已读取完成的事件列表
+type eventSource interface {
+	Next() (parser.SSEEvent, error)
+	Close() error
+}
+
+// responseEvents 从上游响应体中边读取边解析事件
+type responseEvents struct {
+	*parser.Decoder
+	body io.ReadCloser
+
+	model    string
+	start    time.Time // 发出上游请求的时间，用于统计首个事件的延迟
+	gotEvent bool
+}
+
+func (r *responseEvents) Next() (parser.SSEEvent, error) {
+	e, err := r.Decoder.Next()
+	if err == nil && !r.gotEvent {
+		r.gotEvent = true
+		upstreamTTFBSeconds.observeSince(r.start, modelLabel(r.model))
+	}
+	return e, err
+}
+
+func (r *responseEvents) Close() error {
+	return r.body.Close()
+}
+
+// bufferedEvents 依次返回已经读取完成的事件
+type bufferedEvents struct {
+	events []parser.SSEEvent
+}
+
+func (b *bufferedEvents) Next() (parser.SSEEvent, error) {
+	if len(b.events) == 0 {
+		return parser.SSEEvent{}, io.EOF
+	}
+	e := b.events[0]
+	b.events = b.events[1:]
+	return e, nil
+}
+
+func (b *bufferedEvents) Close() error {
+	return nil
+}
+
+// callCodeWhisperer 发送请求到 CodeWhisperer，限流、5xx 和连接错误按配置退避重试，
+// 状态码非 200 时返回 *upstreamError
+func callCodeWhisperer(ctx context.Context, cwReq CodeWhispererRequest, accessToken string) (*http.Response, error) {
+	cwReqBody, err := jsonStr.Marshal(cwReq)
+	if err != nil {
+		return nil, fmt.Errorf("序列化请求失败: %v", err)
+	}
+
+	retry := config().Retry
+	start := time.Now()
+	for attempt := 0; ; attempt++ {
+		resp, err := sendCodeWhisperer(ctx, cwReqBody, accessToken)
+		if ctx.Err() == nil {
+			accounts.recordUpstream(requestInfoFrom(ctx).Account, err)
+		}
+		if err == nil {
+			return resp, nil
+		}
+
+		reason := retryReason(err)
+		if reason == "" || ctx.Err() != nil || attempt >= retry.MaxRetries {
+			return nil, err
+		}
+
+		wait := retryBackoff(retry, attempt, err)
+		if time.Since(start)+wait > time.Duration(retry.Deadline) {
+			log.Printf("CodeWhisperer 请求重试将超出总时限 %v，不再重试: %v", time.Duration(retry.Deadline), err)
+			return nil, err
+		}
+
+		upstreamRetriesTotal.inc(reason)
+		log.Printf("CodeWhisperer 请求失败 (%s)，%v 后进行第 %d 次重试: %v", reason, wait.Round(time.Millisecond), attempt+1, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// sendCodeWhisperer 发送一次 CodeWhisperer 请求
+func sendCodeWhisperer(ctx context.Context, cwReqBody []byte, accessToken string) (*http.Response, error) {
+	ctx, span := startSpan(ctx, "codewhisperer.generateAssistantResponse")
+	defer span.end()
+	if span != nil {
+		span.Kind = spanKindClient
+	}
+	span.setAttr("http.request_content_length", len(cwReqBody))
+
+	proxyReq, err := http.NewRequestWithContext(ctx, http.MethodPost, codeWhispererURL, bytes.NewReader(cwReqBody))
+	if err != nil {
+		return nil, fmt.Errorf("创建代理请求失败: %v", err)
+	}
+
+	proxyReq.Header.Set("Authorization", "Bearer "+accessToken)
+	proxyReq.Header.Set("Content-Type", "application/json")
+	proxyReq.Header.Set("Accept", "text/event-stream")
+
+	start := time.Now()
+	resp, err := upstreamClient().Do(proxyReq)
+	if err != nil {
+		upstreamLatencySeconds.observeSince(start, "error")
+		span.setError(err)
+		return nil, &upstreamConnError{Err: err}
+	}
+	upstreamLatencySeconds.observeSince(start, strconv.Itoa(resp.StatusCode))
+	span.setAttr("http.status_code", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		upstreamErr := &upstreamError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+		span.setError(upstreamErr)
+		return nil, upstreamErr
+	}
+
+	return resp, nil
+}
+
+// retryReason 返回错误对应的重试原因，不可重试时返回空字符串
+func retryReason(err error) string {
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) {
+		switch {
+		case upstreamErr.StatusCode == http.StatusTooManyRequests:
+			return "throttled"
+		case upstreamErr.StatusCode >= 500:
+			return "server_error"
+		}
+		return ""
+	}
+
+	var connErr *upstreamConnError
+	if errors.As(err, &connErr) {
+		return "connection_error"
+	}
+	return ""
+}
+
+// retryBackoff 计算第 attempt 次重试前的等待时间：指数退避并加入随机抖动，
+// 上游指定了 Retry-After 时至少等待该时间
+func retryBackoff(retry RetryConfig, attempt int, err error) time.Duration {
+	backoff := time.Duration(retry.InitialBackoff) << attempt
+	if backoff <= 0 || backoff > time.Duration(retry.MaxBackoff) {
+		backoff = time.Duration(retry.MaxBackoff)
+	}
+	// 在 [backoff/2, backoff] 之间随机，避免多个请求同时重试
+	wait := backoff / 2
+	if half := int64(backoff - wait); half > 0 {
+		wait += time.Duration(rand.Int64N(half + 1))
+	}
+
+	var upstreamErr *upstreamError
+	if errors.As(err, &upstreamErr) && upstreamErr.RetryAfter > wait {
+		wait = upstreamErr.RetryAfter
+	}
+	return wait
+}
+
+// parseRetryAfter 解析 Retry-After 响应头，支持秒数和 HTTP 日期两种格式
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// openEventStream 构建并发送 CodeWhisperer 请求，返回上游事件源。
+// tool_choice 要求调用工具时需要先读取完整响应进行检查，见 fetchRequiredToolUse
+func openEventStream(ctx context.Context, anthropicReq AnthropicRequest, accessToken string) (eventSource, error) {
+	_, span := startSpan(ctx, "buildCodeWhispererRequest")
+	cwReq := buildCodeWhispererRequest(anthropicReq)
+	span.setAttr("messages", len(anthropicReq.Messages))
+	span.setAttr("history", len(cwReq.ConversationState.History))
+	span.setAttr("tools", len(anthropicReq.Tools))
+	span.end()
+
+	if requiresToolUse(anthropicReq) {
+		return fetchRequiredToolUse(ctx, cwReq, requiredToolName(anthropicReq), accessToken)
+	}
+
+	start := time.Now()
+	resp, err := callCodeWhisperer(ctx, cwReq, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	return &responseEvents{
+		Decoder: parser.NewDecoder(resp.Body),
+		body:    resp.Body,
+		model:   anthropicReq.Model,
+		start:   start,
+	}, nil
+}
+
+// readAllEvents 读取并解析完整的上游响应
+func readAllEvents(ctx context.Context, resp *http.Response) ([]parser.SSEEvent, error) {
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("CodeWhisperer Error 读取响应失败: %v", err)
+	}
+
+	_, span := startSpan(ctx, "ParseEvents")
+	events := parser.ParseEvents(respBody)
+	span.setAttr("bytes", len(respBody))
+	span.setAttr("events", len(events))
+	span.end()
+	return events, nil
+}
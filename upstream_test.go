@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setRetryConfig 在测试期间使用较短的重试等待时间
+func setRetryConfig(t *testing.T, retry RetryConfig) {
+	t.Helper()
+
+	cfg := defaultConfig()
+	cfg.Retry = retry
+	previous := currentConfig.Swap(cfg)
+	t.Cleanup(func() { currentConfig.Store(previous) })
+}
+
+// statusSequenceUpstream 依次返回给定的状态码，之后一直返回 200
+func statusSequenceUpstream(t *testing.T, statuses ...int) *atomic.Int32 {
+	t.Helper()
+
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1)) - 1
+		if n < len(statuses) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(statuses[n])
+			return
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	originalURL := codeWhispererURL
+	codeWhispererURL = upstream.URL
+	t.Cleanup(func() { codeWhispererURL = originalURL })
+	return &calls
+}
+
+func TestCallCodeWhispererRetries(t *testing.T) {
+	setRetryConfig(t, RetryConfig{
+		MaxRetries:     3,
+		InitialBackoff: Duration(time.Millisecond),
+		MaxBackoff:     Duration(5 * time.Millisecond),
+		Deadline:       Duration(time.Second),
+	})
+	calls := statusSequenceUpstream(t, http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	throttled := upstreamRetriesTotal.value("throttled")
+
+	resp, err := callCodeWhisperer(context.Background(), CodeWhispererRequest{}, "token")
+	if err != nil {
+		t.Fatalf("callCodeWhisperer: %v", err)
+	}
+	resp.Body.Close()
+
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("upstream calls = %d, want 3", got)
+	}
+	if got := upstreamRetriesTotal.value("throttled") - throttled; got != 1 {
+		t.Fatalf("throttled retries = %v, want 1", got)
+	}
+}
+
+func TestCallCodeWhispererRetryLimits(t *testing.T) {
+	setRetryConfig(t, RetryConfig{
+		MaxRetries:     2,
+		InitialBackoff: Duration(time.Millisecond),
+		MaxBackoff:     Duration(time.Millisecond),
+		Deadline:       Duration(time.Second),
+	})
+
+	// 不可重试的状态码直接返回
+	calls := statusSequenceUpstream(t, http.StatusBadRequest)
+	_, err := callCodeWhisperer(context.Background(), CodeWhispererRequest{}, "token")
+	var upstreamErr *upstreamError
+	if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != http.StatusBadRequest || calls.Load() != 1 {
+		t.Fatalf("err = %v, calls = %d, want a single 400", err, calls.Load())
+	}
+
+	// 超过重试次数后返回最后一次的错误
+	calls = statusSequenceUpstream(t, 500, 502, 503, 504)
+	_, err = callCodeWhisperer(context.Background(), CodeWhispererRequest{}, "token")
+	if !errors.As(err, &upstreamErr) || upstreamErr.StatusCode != 503 || calls.Load() != 3 {
+		t.Fatalf("err = %v, calls = %d, want 503 after 3 calls", err, calls.Load())
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	retry := RetryConfig{InitialBackoff: Duration(100 * time.Millisecond), MaxBackoff: Duration(time.Second)}
+
+	for attempt, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		wait := retryBackoff(retry, attempt, errors.New("connection reset"))
+		if wait < max/2 || wait > max {
+			t.Fatalf("attempt %d: wait %v not in [%v, %v]", attempt, wait, max/2, max)
+		}
+	}
+
+	err := &upstreamError{StatusCode: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}
+	if wait := retryBackoff(retry, 0, err); wait != 5*time.Second {
+		t.Fatalf("wait = %v, want Retry-After of 5s", wait)
+	}
+	if got := parseRetryAfter("7"); got != 7*time.Second {
+		t.Fatalf("parseRetryAfter = %v, want 7s", got)
+	}
+}
+
+func TestClientCancellationAbortsUpstream(t *testing.T) {
+	setupFakeUpstream(t)
+
+	raw, err := os.ReadFile(filepath.Join("parser", "response.raw"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamCancelled := make(chan struct{}, 2)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 返回部分响应后保持连接，直到代理取消请求
+		w.Write(raw)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			upstreamCancelled <- struct{}{}
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer upstream.Close()
+	codeWhispererURL = upstream.URL
+
+	for _, stream := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		start := time.Now()
+		handleMessages(httptest.NewRecorder(), messagesRequest(stream).WithContext(ctx))
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("stream=%v: handler returned after %v, want prompt return on cancellation", stream, elapsed)
+		}
+
+		select {
+		case <-upstreamCancelled:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("stream=%v: upstream request was not cancelled", stream)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	jsonStr "encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// usageRecord 用量账本中的一条记录，每个成功完成的请求写入一行
+type usageRecord struct {
+	Time         time.Time `json:"time"`
+	RequestId    string    `json:"request_id"`
+	Client       string    `json:"client"`
+	Model        string    `json:"model"`
+	Stream       bool      `json:"stream"`
+	InputTokens  int       `json:"input_tokens"`
+	OutputTokens int       `json:"output_tokens"`
+	LatencyMs    int64     `json:"latency_ms"`
+	StopReason   string    `json:"stop_reason"`
+	Account      string    `json:"account"`
+}
+
+// getUsageLedgerPath 返回用量账本路径，默认为 ~/.kiro2cc/usage.jsonl
+func getUsageLedgerPath() string {
+	if path := config().Usage.Ledger; path != "" {
+		return path
+	}
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".kiro2cc", "usage.jsonl")
+}
+
+// usageLedgerMu 保证并发请求写入的记录不会交错
+var usageLedgerMu sync.Mutex
+
+// appendUsage 以追加方式写入一条用量记录
+func appendUsage(record usageRecord) error {
+	if config().Usage.Disabled {
+		return nil
+	}
+	path := getUsageLedgerPath()
+	if path == "" {
+		return fmt.Errorf("无法确定用量账本路径")
+	}
+
+	data, err := jsonStr.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	usageLedgerMu.Lock()
+	defer usageLedgerMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// readUsage 读取用量账本中 [from, to) 时间范围内的记录，from 或 to 为零值时不限制
+func readUsage(path string, from, to time.Time) ([]usageRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []usageRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var record usageRecord
+		if err := jsonStr.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// 跳过写入中断造成的不完整记录
+			fmt.Fprintf(os.Stderr, "跳过第 %d 行无效记录: %v\n", line, err)
+			continue
+		}
+		if (!from.IsZero() && record.Time.Before(from)) || (!to.IsZero() && !record.Time.Before(to)) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// usageSummary 按分组汇总的用量
+type usageSummary struct {
+	Day          string `json:"day,omitempty"`
+	Client       string `json:"client,omitempty"`
+	Model        string `json:"model,omitempty"`
+	Requests     int    `json:"requests"`
+	InputTokens  int    `json:"input_tokens"`
+	OutputTokens int    `json:"output_tokens"`
+	AvgLatencyMs int64  `json:"avg_latency_ms"`
+
+	totalLatencyMs int64
+}
+
+// summarizeUsage 按 groupBy 中的维度（day、key、model）汇总用量，日期按本地时间计算
+func summarizeUsage(records []usageRecord, groupBy []string) []*usageSummary {
+	groups := map[string]*usageSummary{}
+	for _, record := range records {
+		var key usageSummary
+		for _, dimension := range groupBy {
+			switch dimension {
+			case "day":
+				key.Day = record.Time.Local().Format(time.DateOnly)
+			case "key":
+				key.Client = record.Client
+			case "model":
+				key.Model = record.Model
+			}
+		}
+
+		id := key.Day + "\x00" + key.Client + "\x00" + key.Model
+		summary := groups[id]
+		if summary == nil {
+			summary = &usageSummary{Day: key.Day, Client: key.Client, Model: key.Model}
+			groups[id] = summary
+		}
+		summary.Requests++
+		summary.InputTokens += record.InputTokens
+		summary.OutputTokens += record.OutputTokens
+		summary.totalLatencyMs += record.LatencyMs
+	}
+
+	summaries := make([]*usageSummary, 0, len(groups))
+	for _, summary := range groups {
+		summary.AvgLatencyMs = summary.totalLatencyMs / int64(summary.Requests)
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Client != b.Client {
+			return a.Client < b.Client
+		}
+		return a.Model < b.Model
+	})
+	return summaries
+}
+
+// writeUsage 按 format（table、csv、json）输出汇总结果
+func writeUsage(w io.Writer, summaries []*usageSummary, groupBy []string, format string) error {
+	header := append([]string{}, groupBy...)
+	header = append(header, "requests", "input_tokens", "output_tokens", "avg_latency_ms")
+	rows := make([][]string, 0, len(summaries))
+	for _, s := range summaries {
+		var row []string
+		for _, dimension := range groupBy {
+			switch dimension {
+			case "day":
+				row = append(row, s.Day)
+			case "key":
+				row = append(row, s.Client)
+			case "model":
+				row = append(row, s.Model)
+			}
+		}
+		row = append(row,
+			strconv.Itoa(s.Requests),
+			strconv.Itoa(s.InputTokens),
+			strconv.Itoa(s.OutputTokens),
+			strconv.FormatInt(s.AvgLatencyMs, 10),
+		)
+		rows = append(rows, row)
+	}
+
+	switch format {
+	case "json":
+		encoder := jsonStr.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summaries)
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write(header)
+		writer.WriteAll(rows)
+		return writer.Error()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("未知的输出格式: %s", format)
+}
+
+// parseUsageDate 解析 YYYY-MM-DD 格式的本地日期
+func parseUsageDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.ParseInLocation(time.DateOnly, value, time.Local)
+}
+
+// runUsage 实现 kiro2cc usage 命令
+func runUsage(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	from := flags.String("from", "", "起始日期（包含），格式 YYYY-MM-DD")
+	to := flags.String("to", "", "结束日期（包含），格式 YYYY-MM-DD")
+	by := flags.String("by", "day,key,model", "汇总维度，可选 day、key、model，以逗号分隔")
+	format := flags.String("format", "table", "输出格式: table、csv、json")
+	ledger := flags.String("ledger", getUsageLedgerPath(), "用量账本路径")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var groupBy []string
+	for _, dimension := range strings.Split(*by, ",") {
+		dimension = strings.TrimSpace(dimension)
+		switch dimension {
+		case "day", "key", "model":
+			groupBy = append(groupBy, dimension)
+		case "":
+		default:
+			return fmt.Errorf("未知的汇总维度: %s", dimension)
+		}
+	}
+
+	fromTime, err := parseUsageDate(*from)
+	if err != nil {
+		return fmt.Errorf("起始日期格式错误: %v", err)
+	}
+	toTime, err := parseUsageDate(*to)
+	if err != nil {
+		return fmt.Errorf("结束日期格式错误: %v", err)
+	}
+	if !toTime.IsZero() {
+		toTime = toTime.AddDate(0, 0, 1)
+	}
+
+	records, err := readUsage(*ledger, fromTime, toTime)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("用量账本 %s 不存在，启动代理服务器并处理请求后才会生成", *ledger)
+	}
+	if err != nil {
+		return fmt.Errorf("读取用量账本失败: %v", err)
+	}
+
+	return writeUsage(stdout, summarizeUsage(records, groupBy), groupBy, *format)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	jsonStr "encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleMessagesAppendsUsage(t *testing.T) {
+	setupFakeUpstream(t)
+
+	ledger := filepath.Join(t.TempDir(), "usage.jsonl")
+	cfg := defaultConfig()
+	cfg.Usage.Ledger = ledger
+	previous := currentConfig.Swap(cfg)
+	defer currentConfig.Store(previous)
+
+	for _, stream := range []bool{false, true} {
+		req := messagesRequest(stream)
+		req.Header.Set("x-api-key", "team-key")
+		rec := httptest.NewRecorder()
+		handleMessages(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d", rec.Code)
+		}
+	}
+
+	records, err := readUsage(ledger, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("records = %d, want 2", len(records))
+	}
+	for i, record := range records {
+		if record.Client != clientLabel("team-key") || record.Model != "claude-sonnet-4-20250514" ||
+			record.StopReason != "tool_use" || record.Account != defaultAccount ||
+			record.InputTokens == 0 || record.OutputTokens == 0 || record.Stream != (i == 1) ||
+			!strings.HasPrefix(record.RequestId, "req_") {
+			t.Errorf("record %d = %+v", i, record)
+		}
+	}
+}
+
+// writeLedger 写入测试用的用量记录
+func writeLedger(t *testing.T, records ...usageRecord) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	for _, record := range records {
+		data, _ := jsonStr.Marshal(record)
+		buf.Write(append(data, '\n'))
+	}
+	buf.WriteString("{truncated\n")
+
+	path := filepath.Join(t.TempDir(), "usage.jsonl")
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunUsage(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2025, 3, d, 12, 0, 0, 0, time.Local) }
+	ledger := writeLedger(t,
+		usageRecord{Time: day(1), Client: "key-a", Model: "m1", InputTokens: 100, OutputTokens: 10, LatencyMs: 100},
+		usageRecord{Time: day(1), Client: "key-a", Model: "m1", InputTokens: 50, OutputTokens: 5, LatencyMs: 300},
+		usageRecord{Time: day(1), Client: "key-b", Model: "m1", InputTokens: 7, OutputTokens: 1, LatencyMs: 50},
+		usageRecord{Time: day(2), Client: "key-a", Model: "m2", InputTokens: 20, OutputTokens: 2, LatencyMs: 10},
+		usageRecord{Time: day(3), Client: "key-a", Model: "m2", InputTokens: 30, OutputTokens: 3, LatencyMs: 10},
+	)
+
+	var out bytes.Buffer
+	if err := runUsage([]string{"--ledger", ledger, "--format", "csv"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	want := `day,key,model,requests,input_tokens,output_tokens,avg_latency_ms
+2025-03-01,key-a,m1,2,150,15,200
+2025-03-01,key-b,m1,1,7,1,50
+2025-03-02,key-a,m2,1,20,2,10
+2025-03-03,key-a,m2,1,30,3,10
+`
+	if out.String() != want {
+		t.Fatalf("csv output:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := runUsage([]string{"--ledger", ledger, "--by", "key", "--from", "2025-03-02", "--to", "2025-03-03", "--format", "json"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	var summaries []usageSummary
+	if err := jsonStr.Unmarshal(out.Bytes(), &summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Client != "key-a" || summaries[0].Requests != 2 || summaries[0].InputTokens != 50 {
+		t.Fatalf("json summaries = %+v", summaries)
+	}
+
+	out.Reset()
+	if err := runUsage([]string{"--ledger", ledger, "--by", "model"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), "MODEL  REQUESTS") || !strings.Contains(out.String(), "m2     2") {
+		t.Fatalf("table output:\n%s", out.String())
+	}
+
+	if err := runUsage([]string{"--ledger", ledger, "--by", "user"}, &out); err == nil {
+		t.Fatal("unknown dimension accepted")
+	}
+}